@@ -11,6 +11,9 @@ require (
 	github.com/inspii/microkit v0.0.0-20220225024007-5fc36914078c
 	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.7.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	google.golang.org/grpc v1.45.0
 	google.golang.org/protobuf v1.27.1
 )
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
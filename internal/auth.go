@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 业务系统认证方式
+const (
+	AuthModeCallback = "callback" // 回调业务系统，见 HTTPAuthenticator
+	AuthModeJWT      = "jwt"      // 本地校验 JWT，见 JWTAuthenticator
+	AuthModeHMAC     = "hmac"     // 本地校验 HMAC 令牌，见 HMACAuthenticator
+)
+
+// AuthConfig 业务系统的认证配置
+type AuthConfig struct {
+	Mode        string `json:"mode"`
+	CallbackURL string `json:"callback_url,omitempty"` // callback 模式的回调地址
+	Secret      string `json:"secret,omitempty"`       // hmac 模式的密钥，或 jwt 模式的 HS256 密钥
+	JWKSFile    string `json:"jwks_file,omitempty"`    // jwt 模式的本地 JWKS 文件
+
+	// callback 模式的请求选项，见 HTTPAuthOptions
+	Timeout      Duration `json:"timeout,omitempty"`       // 单次请求超时，默认 3s
+	Retries      int      `json:"retries,omitempty"`       // 请求失败后的重试次数，默认不重试
+	RetryBackoff Duration `json:"retry_backoff,omitempty"` // 重试间隔，每次翻倍，默认 100ms
+
+	Issuer        string   `json:"issuer,omitempty"`
+	Audience      string   `json:"audience,omitempty"`
+	IdentityClaim string   `json:"identity_claim,omitempty"` // 默认 sub
+	IndexedClaims []string `json:"indexed_claims,omitempty"`
+	Leeway        Duration `json:"leeway,omitempty"`          // 校验过期时间时允许的时钟误差
+	AllowNoExpiry bool     `json:"allow_no_expiry,omitempty"` // jwt 模式接受没有 exp 的 token
+
+	WorkerToken string `json:"worker_token,omitempty"` // 业务系统连接 /service/conn 时的 Authorization: Bearer <token>
+}
+
+// Duration JSON 中以时长字符串表示，如 "30s"，解码时也接受秒数
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	return nil
+}
+
+// NewAuthenticator 按认证方式创建 Authenticator
+func NewAuthenticator(cfg AuthConfig) (Authenticator, error) {
+	switch cfg.Mode {
+	case AuthModeCallback:
+		if cfg.CallbackURL == "" {
+			return nil, errors.New("auth: callback_url is required")
+		}
+		if cfg.Retries < 0 {
+			return nil, errors.New("auth: retries must not be negative")
+		}
+		return NewHTTPAuthenticatorWithOptions(cfg.CallbackURL, HTTPAuthOptions{
+			Timeout:      time.Duration(cfg.Timeout),
+			Retries:      cfg.Retries,
+			RetryBackoff: time.Duration(cfg.RetryBackoff),
+		}), nil
+	case AuthModeJWT:
+		opts := JWTOptions{
+			Issuer:        cfg.Issuer,
+			Audience:      cfg.Audience,
+			IdentityClaim: cfg.IdentityClaim,
+			IndexedClaims: cfg.IndexedClaims,
+			Leeway:        time.Duration(cfg.Leeway),
+			AllowNoExpiry: cfg.AllowNoExpiry,
+		}
+		if cfg.Secret != "" {
+			opts.Keys = append(opts.Keys, JWTKey{Algorithm: JWTAlgHS256, Key: []byte(cfg.Secret)})
+		}
+		if cfg.JWKSFile != "" {
+			keys, err := LoadJWKS(cfg.JWKSFile)
+			if err != nil {
+				return nil, err
+			}
+			opts.Keys = append(opts.Keys, keys...)
+		}
+		return NewJWTAuthenticator(opts)
+	case AuthModeHMAC:
+		if cfg.Secret == "" {
+			return nil, errors.New("auth: secret is required")
+		}
+		return NewHMACAuthenticator([]byte(cfg.Secret), time.Duration(cfg.Leeway)), nil
+	default:
+		return nil, fmt.Errorf("auth: unknown mode %q", cfg.Mode)
+	}
+}
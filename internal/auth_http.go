@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	errAuthRejected = errors.New("auth rejected")
+)
+
+type HTTPAuthOptions struct {
+	Client           *http.Client  // 默认 http.DefaultClient
+	Timeout          time.Duration // 单次请求超时，默认 3s
+	Retries          int           // 请求失败（网络错误、超时）后的重试次数，默认不重试
+	RetryBackoff     time.Duration // 重试间隔，每次翻倍，默认 100ms
+	BreakerThreshold int           // 连续失败多少次后熔断，默认 5
+	BreakerCooldown  time.Duration // 熔断后多久允许试探请求，默认 10s
+}
+
+// httpAuthResponse 认证回调的响应
+type httpAuthResponse struct {
+	Identity string      `json:"identity"`
+	Indexed  IndexEntry  `json:"indexed"`
+	Extra    interface{} `json:"extra"`
+}
+
+// HTTPAuthenticator 通过业务系统的认证回调认证客户端，见 openapi/comet.yaml 中的 {auth_callback_addr}；
+// 非 2xx 响应视为拒绝，请求失败、熔断或 ctx 结束时返回 ErrAuthUnavailable
+type HTTPAuthenticator struct {
+	url     string
+	client  *http.Client
+	opts    HTTPAuthOptions
+	breaker *circuitBreaker
+}
+
+func NewHTTPAuthenticator(url string) *HTTPAuthenticator {
+	return NewHTTPAuthenticatorWithOptions(url, HTTPAuthOptions{})
+}
+
+func NewHTTPAuthenticatorWithOptions(url string, opts HTTPAuthOptions) *HTTPAuthenticator {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 3 * time.Second
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = 100 * time.Millisecond
+	}
+	if opts.BreakerThreshold <= 0 {
+		opts.BreakerThreshold = 5
+	}
+	if opts.BreakerCooldown <= 0 {
+		opts.BreakerCooldown = 10 * time.Second
+	}
+	return &HTTPAuthenticator{
+		url:     url,
+		client:  opts.Client,
+		opts:    opts,
+		breaker: &circuitBreaker{threshold: opts.BreakerThreshold, cooldown: opts.BreakerCooldown},
+	}
+}
+
+func (a *HTTPAuthenticator) Auth(ctx context.Context, req AuthRequest) (ServiceIdentity, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return ServiceIdentity{}, err
+	}
+
+	backoff := a.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		if !a.breaker.allow() {
+			return ServiceIdentity{}, fmt.Errorf("%w: circuit open", ErrAuthUnavailable)
+		}
+		identity, err := a.post(ctx, body)
+		if err == nil || errors.Is(err, errAuthRejected) {
+			a.breaker.success()
+			return identity, err
+		}
+		// 调用者取消的请求不计入失败
+		if ctx.Err() != nil {
+			a.breaker.abort()
+			return ServiceIdentity{}, fmt.Errorf("%w: %v", ErrAuthUnavailable, ctx.Err())
+		}
+		a.breaker.failure()
+		if attempt >= a.opts.Retries {
+			return ServiceIdentity{}, fmt.Errorf("%w: %v", ErrAuthUnavailable, err)
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ServiceIdentity{}, fmt.Errorf("%w: %v", ErrAuthUnavailable, ctx.Err())
+		}
+		backoff *= 2
+	}
+}
+
+func (a *HTTPAuthenticator) post(ctx context.Context, body []byte) (ServiceIdentity, error) {
+	client := *a.client
+	client.Timeout = a.opts.Timeout
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return ServiceIdentity{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return ServiceIdentity{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(io.Discard, resp.Body)
+		return ServiceIdentity{}, fmt.Errorf("%w: status %d", errAuthRejected, resp.StatusCode)
+	}
+	var res httpAuthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return ServiceIdentity{}, fmt.Errorf("invalid auth response: %v", err)
+	}
+	if res.Identity == "" {
+		return ServiceIdentity{}, fmt.Errorf("%w: empty identity", errAuthRejected)
+	}
+	return ServiceIdentity{
+		Identity:    res.Identity,
+		IndexedInfo: res.Indexed,
+		ExtraInfo:   res.Extra,
+	}, nil
+}
+
+// circuitBreaker 连续失败 threshold 次后熔断，cooldown 后允许一个试探请求，成功后恢复
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+}
+
+// abort 请求被调用者取消，不计入成功或失败，允许新的试探请求
+func (b *circuitBreaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+func (b *circuitBreaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+	b.probing = false
+}
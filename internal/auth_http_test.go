@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPAuthenticator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req AuthRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Token != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"identity": "user-" + req.ClientID,
+			"indexed":  map[string]string{"ip": req.IP},
+			"extra":    map[string]interface{}{"vip": true},
+		})
+	}))
+	defer server.Close()
+
+	auth := NewHTTPAuthenticator(server.URL)
+	identity, err := auth.Auth(context.Background(), AuthRequest{ClientID: "1000", Token: "secret", IP: "10.0.0.1"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if identity.Identity != "user-1000" || identity.IndexedInfo["ip"] != "10.0.0.1" {
+		t.Fatalf("Unexpected identity %+v", identity)
+	}
+	if extra, _ := identity.ExtraInfo.(map[string]interface{}); extra["vip"] != true {
+		t.Fatalf("Unexpected extra info %+v", identity.ExtraInfo)
+	}
+
+	if _, err := auth.Auth(context.Background(), AuthRequest{Token: "wrong"}); !errors.Is(err, errAuthRejected) {
+		t.Fatalf("Expected errAuthRejected, got %v", err)
+	}
+}
+
+func TestHTTPAuthenticatorRetry(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(`{"identity":"1000"}`))
+	}))
+	defer server.Close()
+
+	auth := NewHTTPAuthenticatorWithOptions(server.URL, HTTPAuthOptions{
+		Timeout:      50 * time.Millisecond,
+		Retries:      1,
+		RetryBackoff: time.Millisecond,
+	})
+	identity, err := auth.Auth(context.Background(), AuthRequest{Token: "secret"})
+	if err != nil || identity.Identity != "1000" {
+		t.Fatalf("Expected the retry to succeed, got %+v, %v", identity, err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("Expected 2 calls, got %d", n)
+	}
+}
+
+func TestHTTPAuthenticatorCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not json"))
+	}))
+	defer server.Close()
+
+	auth, err := NewAuthenticator(AuthConfig{Mode: AuthModeCallback, CallbackURL: server.URL, Retries: 3, RetryBackoff: Duration(time.Hour)})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts := auth.(*HTTPAuthenticator).opts; opts.Retries != 3 || opts.RetryBackoff != time.Hour || opts.Timeout != 3*time.Second {
+		t.Fatalf("Unexpected options %+v", opts)
+	}
+
+	// The caller gives up while the authenticator waits to retry.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := auth.Auth(ctx, AuthRequest{}); !errors.Is(err, ErrAuthUnavailable) {
+		t.Fatalf("Expected ErrAuthUnavailable, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Expected the retry to be cancelled, took %v", d)
+	}
+}
+
+func TestHTTPAuthenticatorCircuitBreaker(t *testing.T) {
+	var calls int32
+	var healthy atomic.Value
+	healthy.Store(false)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if !healthy.Load().(bool) {
+			w.Write([]byte("not json"))
+			return
+		}
+		w.Write([]byte(`{"identity":"1000"}`))
+	}))
+	defer server.Close()
+
+	auth := NewHTTPAuthenticatorWithOptions(server.URL, HTTPAuthOptions{
+		BreakerThreshold: 2,
+		BreakerCooldown:  50 * time.Millisecond,
+	})
+	for i := 0; i < 4; i++ {
+		if _, err := auth.Auth(context.Background(), AuthRequest{}); !errors.Is(err, ErrAuthUnavailable) {
+			t.Fatalf("Expected ErrAuthUnavailable, got %v", err)
+		}
+	}
+	// The breaker opened after two failures.
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("Expected 2 calls, got %d", n)
+	}
+
+	healthy.Store(true)
+	time.Sleep(60 * time.Millisecond)
+	if _, err := auth.Auth(context.Background(), AuthRequest{}); err != nil {
+		t.Fatalf("Expected the probe to close the breaker, got %v", err)
+	}
+	if _, err := auth.Auth(context.Background(), AuthRequest{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestServiceHTTPAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	c, _ := newTestComet(t)
+	c.pool.AddService(&serviceImpl{info: ServiceInfo{Name: "news"}, auth: NewHTTPAuthenticator(server.URL)})
+	if _, err := c.AuthPeer(context.Background(), PeerInfo{Service: "news"}); !errors.Is(err, errPeerUnauthorized) {
+		t.Fatalf("Expected errPeerUnauthorized, got %v", err)
+	}
+}
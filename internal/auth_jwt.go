@@ -0,0 +1,325 @@
+package internal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errTokenInvalid = errors.New("invalid token")
+	errTokenExpired = errors.New("token expired")
+)
+
+// JWT 签名算法
+const (
+	JWTAlgHS256 = "HS256"
+	JWTAlgRS256 = "RS256"
+	JWTAlgES256 = "ES256"
+)
+
+// JWTKey 验证签名的密钥，Key 为 HS256 的 []byte、RS256 的 *rsa.PublicKey 或 ES256 的 *ecdsa.PublicKey
+type JWTKey struct {
+	ID        string // 对应 JWT 头部的 kid，为空时匹配任意 kid
+	Algorithm string
+	Key       interface{}
+}
+
+type JWTOptions struct {
+	Keys          []JWTKey
+	Issuer        string        // 不为空时校验 iss
+	Audience      string        // 不为空时校验 aud
+	IdentityClaim string        // 作为 ServiceIdentity.Identity 的声明，默认 sub
+	IndexedClaims []string      // 作为 ServiceIdentity.IndexedInfo 的声明
+	Leeway        time.Duration // 校验 exp、nbf 时允许的时钟误差
+	AllowNoExpiry bool          // 为 true 时接受没有 exp 的 token，默认拒绝
+}
+
+// JWTAuthenticator 本地校验 JWT，支持 HS256、RS256、ES256
+type JWTAuthenticator struct {
+	opts JWTOptions
+	now  func() time.Time
+}
+
+func NewJWTAuthenticator(opts JWTOptions) (*JWTAuthenticator, error) {
+	if len(opts.Keys) == 0 {
+		return nil, errors.New("jwt: no keys")
+	}
+	for _, key := range opts.Keys {
+		if err := checkJWTKey(key); err != nil {
+			return nil, err
+		}
+	}
+	if opts.IdentityClaim == "" {
+		opts.IdentityClaim = "sub"
+	}
+	return &JWTAuthenticator{opts: opts, now: time.Now}, nil
+}
+
+func checkJWTKey(key JWTKey) error {
+	var ok bool
+	switch key.Algorithm {
+	case JWTAlgHS256:
+		var secret []byte
+		secret, ok = key.Key.([]byte)
+		ok = ok && len(secret) > 0
+	case JWTAlgRS256:
+		var pub *rsa.PublicKey
+		pub, ok = key.Key.(*rsa.PublicKey)
+		ok = ok && pub != nil && pub.N != nil && pub.E > 0
+	case JWTAlgES256:
+		var pub *ecdsa.PublicKey
+		pub, ok = key.Key.(*ecdsa.PublicKey)
+		ok = ok && pub != nil && pub.Curve == elliptic.P256() && pub.X != nil && pub.Y != nil &&
+			pub.Curve.IsOnCurve(pub.X, pub.Y)
+	default:
+		return fmt.Errorf("jwt: unsupported algorithm %q", key.Algorithm)
+	}
+	if !ok {
+		return fmt.Errorf("jwt: invalid %s key %q", key.Algorithm, key.ID)
+	}
+	return nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (a *JWTAuthenticator) Auth(ctx context.Context, req AuthRequest) (ServiceIdentity, error) {
+	parts := strings.Split(req.Token, ".")
+	if len(parts) != 3 {
+		return ServiceIdentity{}, fmt.Errorf("%w: malformed jwt", errTokenInvalid)
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return ServiceIdentity{}, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ServiceIdentity{}, fmt.Errorf("%w: %v", errTokenInvalid, err)
+	}
+	if !a.verify(header, []byte(parts[0]+"."+parts[1]), sig) {
+		return ServiceIdentity{}, fmt.Errorf("%w: bad signature", errTokenInvalid)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return ServiceIdentity{}, err
+	}
+	if err := a.validate(claims); err != nil {
+		return ServiceIdentity{}, err
+	}
+
+	identity := claimString(claims[a.opts.IdentityClaim])
+	if identity == "" {
+		return ServiceIdentity{}, fmt.Errorf("%w: missing %s", errTokenInvalid, a.opts.IdentityClaim)
+	}
+	var indexed IndexEntry
+	for _, name := range a.opts.IndexedClaims {
+		if v := claimString(claims[name]); v != "" {
+			if indexed == nil {
+				indexed = make(IndexEntry)
+			}
+			indexed[name] = v
+		}
+	}
+	return ServiceIdentity{Identity: identity, IndexedInfo: indexed}, nil
+}
+
+// verify 使用与头部算法一致的密钥验证签名，防止以其他算法伪造
+func (a *JWTAuthenticator) verify(header jwtHeader, signed, sig []byte) bool {
+	for _, key := range a.opts.Keys {
+		if key.Algorithm != header.Alg || (key.ID != "" && header.Kid != "" && key.ID != header.Kid) {
+			continue
+		}
+		if verifyJWTSignature(key, signed, sig) {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyJWTSignature(key JWTKey, signed, sig []byte) bool {
+	switch key.Algorithm {
+	case JWTAlgHS256:
+		mac := hmac.New(sha256.New, key.Key.([]byte))
+		mac.Write(signed)
+		return hmac.Equal(sig, mac.Sum(nil))
+	case JWTAlgRS256:
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(key.Key.(*rsa.PublicKey), crypto.SHA256, digest[:], sig) == nil
+	case JWTAlgES256:
+		// ES256 签名为 32 字节 r 与 32 字节 s 拼接
+		if len(sig) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(signed)
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key.Key.(*ecdsa.PublicKey), digest[:], r, s)
+	default:
+		return false
+	}
+}
+
+func (a *JWTAuthenticator) validate(claims map[string]interface{}) error {
+	now := a.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok && !a.opts.AllowNoExpiry {
+		return fmt.Errorf("%w: missing exp", errTokenInvalid)
+	}
+	if ok && now.After(time.Unix(int64(exp), 0).Add(a.opts.Leeway)) {
+		return errTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(a.opts.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: not valid yet", errTokenInvalid)
+	}
+	if a.opts.Issuer != "" && claims["iss"] != a.opts.Issuer {
+		return fmt.Errorf("%w: unexpected issuer", errTokenInvalid)
+	}
+	if a.opts.Audience != "" && !claimContains(claims["aud"], a.opts.Audience) {
+		return fmt.Errorf("%w: unexpected audience", errTokenInvalid)
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errTokenInvalid, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %v", errTokenInvalid, err)
+	}
+	return nil
+}
+
+// claimString 字符串或数字声明的字符串形式，其他类型返回空字符串
+func claimString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return ""
+	}
+}
+
+// claimContains aud 可以是字符串或字符串数组
+func claimContains(v interface{}, want string) bool {
+	switch v := v.(type) {
+	case string:
+		return v == want
+	case []interface{}:
+		for _, item := range v {
+			if item == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jwk JWKS 中的一个密钥，支持 RSA、EC P-256 与 oct
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// LoadJWKS 读取本地 JWKS 文件，忽略用途不是签名的密钥
+func LoadJWKS(path string) ([]JWTKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(data)
+}
+
+func ParseJWKS(data []byte) ([]JWTKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %v", err)
+	}
+	keys := make([]JWTKey, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.jwtKey()
+		if err == nil && k.Alg != "" && k.Alg != key.Algorithm {
+			err = fmt.Errorf("unsupported algorithm %q", k.Alg)
+		}
+		// 拒绝不在曲线上的 EC 公钥等无效密钥
+		if err == nil {
+			err = checkJWTKey(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jwks: key %q: %v", k.Kid, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (k jwk) jwtKey() (JWTKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "oct":
+		secret, err := decode(k.K)
+		if err != nil {
+			return JWTKey{}, err
+		}
+		return JWTKey{ID: k.Kid, Algorithm: JWTAlgHS256, Key: secret}, nil
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return JWTKey{}, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return JWTKey{}, err
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return JWTKey{ID: k.Kid, Algorithm: JWTAlgRS256, Key: pub}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return JWTKey{}, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return JWTKey{}, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return JWTKey{}, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		return JWTKey{ID: k.Kid, Algorithm: JWTAlgES256, Key: pub}, nil
+	default:
+		return JWTKey{}, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// signTestJWT signs claims with an HS256 []byte, *rsa.PrivateKey or *ecdsa.PrivateKey.
+func signTestJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Kid: kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	secret := []byte("secret")
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	auth, err := NewJWTAuthenticator(JWTOptions{
+		Keys: []JWTKey{
+			{Algorithm: JWTAlgHS256, Key: secret},
+			{ID: "rsa", Algorithm: JWTAlgRS256, Key: &rsaKey.PublicKey},
+			{ID: "ec", Algorithm: JWTAlgES256, Key: &ecKey.PublicKey},
+		},
+		Issuer:        "chat",
+		Audience:      "comet",
+		IndexedClaims: []string{"room", "level"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	claims := map[string]interface{}{"sub": "1000", "iss": "chat", "aud": []string{"comet"}, "exp": exp, "room": "r1", "level": 3}
+	for _, token := range []string{
+		signTestJWT(t, JWTAlgHS256, "", secret, claims),
+		signTestJWT(t, JWTAlgRS256, "rsa", rsaKey, claims),
+		signTestJWT(t, JWTAlgES256, "ec", ecKey, claims),
+	} {
+		identity, err := auth.Auth(context.Background(), AuthRequest{Token: token})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if identity.Identity != "1000" || identity.IndexedInfo["room"] != "r1" || identity.IndexedInfo["level"] != "3" {
+			t.Fatalf("Unexpected identity %+v", identity)
+		}
+	}
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"malformed", "a.b", errTokenInvalid},
+		{"alg none", signTestJWT(t, "none", "", nil, claims), errTokenInvalid},
+		{"wrong key", signTestJWT(t, JWTAlgRS256, "rsa", otherKey, claims), errTokenInvalid},
+		{"wrong kid", signTestJWT(t, JWTAlgES256, "rsa", ecKey, claims), errTokenInvalid},
+		{"expired", signTestJWT(t, JWTAlgHS256, "", secret, map[string]interface{}{"sub": "1000", "iss": "chat", "aud": "comet", "exp": 1}), errTokenExpired},
+		{"issuer", signTestJWT(t, JWTAlgHS256, "", secret, map[string]interface{}{"sub": "1000", "iss": "news", "aud": "comet", "exp": exp}), errTokenInvalid},
+		{"audience", signTestJWT(t, JWTAlgHS256, "", secret, map[string]interface{}{"sub": "1000", "iss": "chat", "exp": exp}), errTokenInvalid},
+		{"no subject", signTestJWT(t, JWTAlgHS256, "", secret, map[string]interface{}{"iss": "chat", "aud": "comet", "exp": exp}), errTokenInvalid},
+		{"no exp", signTestJWT(t, JWTAlgHS256, "", secret, map[string]interface{}{"sub": "1000", "iss": "chat", "aud": "comet"}), errTokenInvalid},
+	}
+	for _, test := range tests {
+		if _, err := auth.Auth(context.Background(), AuthRequest{Token: test.token}); !errors.Is(err, test.err) {
+			t.Fatalf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	// Tokens without exp are only accepted when explicitly allowed.
+	auth, err = NewJWTAuthenticator(JWTOptions{Keys: []JWTKey{{Algorithm: JWTAlgHS256, Key: secret}}, AllowNoExpiry: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if identity, err := auth.Auth(context.Background(), AuthRequest{Token: signTestJWT(t, JWTAlgHS256, "", secret, map[string]interface{}{"sub": "1000"})}); err != nil || identity.Identity != "1000" {
+		t.Fatalf("Unexpected result %+v, %v", identity, err)
+	}
+
+	for _, key := range []JWTKey{
+		{Algorithm: JWTAlgRS256, Key: (*rsa.PublicKey)(nil)},
+		{Algorithm: JWTAlgRS256, Key: &rsa.PublicKey{}},
+		{Algorithm: JWTAlgES256, Key: (*ecdsa.PublicKey)(nil)},
+	} {
+		if _, err := NewJWTAuthenticator(JWTOptions{Keys: []JWTKey{key}}); err == nil {
+			t.Fatalf("%+v: expected an error", key)
+		}
+	}
+}
+
+func TestLoadJWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "alg": "RS256", "use": "sig", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X.Bytes()), "y": encode(ecKey.Y.Bytes())},
+		{"kty": "oct", "kid": "oct", "k": encode([]byte("secret"))},
+		{"kty": "RSA", "kid": "enc", "use": "enc"},
+	}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(path, jwks, 0600)
+
+	auth, err := NewAuthenticator(AuthConfig{Mode: AuthModeJWT, JWKSFile: path})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	claims := map[string]interface{}{"sub": "1000", "exp": float64(time.Now().Add(time.Hour).Unix())}
+	for _, token := range []string{
+		signTestJWT(t, JWTAlgRS256, "rsa", rsaKey, claims),
+		signTestJWT(t, JWTAlgES256, "ec", ecKey, claims),
+		signTestJWT(t, JWTAlgHS256, "oct", []byte("secret"), claims),
+	} {
+		if identity, err := auth.Auth(context.Background(), AuthRequest{Token: token}); err != nil || identity.Identity != "1000" {
+			t.Fatalf("Unexpected result %+v, %v", identity, err)
+		}
+	}
+
+	if _, err := ParseJWKS([]byte(`{"keys":[{"kty":"EC","crv":"P-384"}]}`)); err == nil {
+		t.Fatalf("Expected an error for an unsupported curve")
+	}
+	offCurve, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "EC", "crv": "P-256", "x": encode(ecKey.X.Bytes()), "y": encode(new(big.Int).Add(ecKey.Y, big.NewInt(1)).Bytes())},
+	}})
+	if _, err := ParseJWKS(offCurve); err == nil {
+		t.Fatalf("Expected an error for a point that is not on the curve")
+	}
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	secret := []byte("secret")
+	auth := NewHMACAuthenticator(secret, 0)
+
+	token := SignHMACToken(secret, "user:1000", time.Now().Add(time.Minute))
+	if identity, err := auth.Auth(context.Background(), AuthRequest{Token: token}); err != nil || identity.Identity != "user:1000" {
+		t.Fatalf("Unexpected result %+v, %v", identity, err)
+	}
+
+	tests := []struct {
+		token string
+		err   error
+	}{
+		{"user", errTokenInvalid},
+		{"user:abc:sig", errTokenInvalid},
+		{SignHMACToken([]byte("other"), "1000", time.Now().Add(time.Minute)), errTokenInvalid},
+		{"2000" + token[len("user:1000"):], errTokenInvalid},
+		{SignHMACToken(secret, "1000", time.Now().Add(-time.Minute)), errTokenExpired},
+	}
+	for _, test := range tests {
+		if _, err := auth.Auth(context.Background(), AuthRequest{Token: test.token}); !errors.Is(err, test.err) {
+			t.Fatalf("%s: expected %v, got %v", test.token, test.err, err)
+		}
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	for _, cfg := range []AuthConfig{
+		{Mode: "ldap"},
+		{Mode: AuthModeCallback},
+		{Mode: AuthModeCallback, CallbackURL: "http://127.0.0.1/auth", Retries: -1},
+		{Mode: AuthModeHMAC},
+		{Mode: AuthModeJWT},
+		{Mode: AuthModeJWT, JWKSFile: filepath.Join(t.TempDir(), "missing.json")},
+	} {
+		if _, err := NewAuthenticator(cfg); err == nil {
+			t.Fatalf("%+v: expected an error", cfg)
+		}
+	}
+
+	auth, err := NewAuthenticator(AuthConfig{Mode: AuthModeHMAC, Secret: "secret"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c, _ := newTestComet(t)
+	c.pool.AddService(&serviceImpl{info: ServiceInfo{Name: "news"}, auth: auth})
+	info, err := c.AuthPeer(context.Background(), PeerInfo{Service: "news", ServiceToken: SignHMACToken([]byte("secret"), "1000", time.Now().Add(time.Minute))})
+	if err != nil || info.ServiceIdentity.Identity != "1000" {
+		t.Fatalf("Unexpected result %+v, %v", info, err)
+	}
+}
+
+func TestAuthConfigLeeway(t *testing.T) {
+	data, _ := json.Marshal(AuthConfig{Mode: AuthModeHMAC, Leeway: Duration(30 * time.Second)})
+	if string(data) != `{"mode":"hmac","leeway":"30s"}` {
+		t.Fatalf("Unexpected JSON %s", data)
+	}
+
+	tests := []struct {
+		data   string
+		leeway time.Duration
+	}{
+		{`{"leeway":"1m30s"}`, 90 * time.Second},
+		{`{"leeway":5}`, 5 * time.Second},
+		{`{}`, 0},
+	}
+	for _, test := range tests {
+		var cfg AuthConfig
+		if err := json.Unmarshal([]byte(test.data), &cfg); err != nil || time.Duration(cfg.Leeway) != test.leeway {
+			t.Fatalf("%s: expected %v, got %v, %v", test.data, test.leeway, time.Duration(cfg.Leeway), err)
+		}
+	}
+	for _, data := range []string{`{"leeway":"soon"}`, `{"leeway":true}`} {
+		var cfg AuthConfig
+		if err := json.Unmarshal([]byte(data), &cfg); err == nil {
+			t.Fatalf("%s: expected an error", data)
+		}
+	}
+}
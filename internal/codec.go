@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	errUnknownProtocol = errors.New("unknown protocol")
+)
+
+// 内置连接协议，可通过 Comet-Protocol 请求头或 WebSocket 子协议指定，默认 JSON
+const (
+	ProtocolJSON     = "json"
+	ProtocolProtobuf = "protobuf"
+	ProtocolMsgpack  = "msgpack"
+)
+
+// Codec 消息编解码，每个 WebSocket 消息对应一条 Message
+type Codec interface {
+	// Name 协议名，不区分大小写
+	Name() string
+	Marshal(msg *Message) ([]byte, error)
+	Unmarshal(data []byte, msg *Message) error
+	// Binary 是否以 WebSocket 二进制消息发送
+	Binary() bool
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[string]Codec)
+)
+
+func init() {
+	RegisterCodec(jsonCodec{})
+	RegisterCodec(protobufCodec{})
+	RegisterCodec(msgpackCodec{})
+}
+
+// RegisterCodec 注册连接协议，同名协议会被替换
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	codecs[strings.ToLower(codec.Name())] = codec
+}
+
+// GetCodec 获取连接协议，protocol 为空时返回 JSON，未注册时返回 errUnknownProtocol
+func GetCodec(protocol string) (Codec, error) {
+	if protocol == "" {
+		protocol = ProtocolJSON
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	codec, ok := codecs[strings.ToLower(protocol)]
+	if !ok {
+		return nil, errUnknownProtocol
+	}
+	return codec, nil
+}
+
+// negotiateProtocol 协商连接协议，Comet-Protocol 请求头优先，其次是客户端提供的第一个已注册的 WebSocket 子协议；
+// 返回的 subprotocol 不为空时需在握手响应中确认
+func negotiateProtocol(r *http.Request) (codec Codec, subprotocol string, err error) {
+	if protocol := r.Header.Get("Comet-Protocol"); protocol != "" {
+		codec, err = GetCodec(protocol)
+		return codec, "", err
+	}
+
+	protocols := websocket.Subprotocols(r)
+	for _, protocol := range protocols {
+		if codec, err := GetCodec(protocol); err == nil {
+			return codec, protocol, nil
+		}
+	}
+	if len(protocols) > 0 {
+		return nil, "", errUnknownProtocol
+	}
+	codec, err = GetCodec(ProtocolJSON)
+	return codec, "", err
+}
+
+// toUnixMilli 消息时间传输时精确到毫秒，零值为0
+func toUnixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMilli(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
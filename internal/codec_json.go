@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// encodingBase64 消息内容不是 UTF-8 文本时，data 为其 base64 编码
+const encodingBase64 = "base64"
+
+// wsMessage 对应 openapi/comet.yaml 中的 WSMessage 与 Message
+type wsMessage struct {
+	ID       string          `json:"id"`
+	Topic    string          `json:"topic"`
+	Data     json.RawMessage `json:"data"`
+	Encoding string          `json:"encoding,omitempty"`
+	Reply    string          `json:"reply,omitempty"`
+	Headers  Header          `json:"headers,omitempty"`
+	Time     int64           `json:"time,omitempty"`
+	Service  string          `json:"service,omitempty"`
+	Identity string          `json:"identity,omitempty"`
+}
+
+// jsonCodec 消息内容为紧凑的 JSON 对象、数组、数字或布尔值时原样作为 data，其他 UTF-8 文本作为字符串，
+// 二进制内容以 base64 编码并设置 encoding；解码时 data 为字符串则取其内容，否则保留原始 JSON
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return ProtocolJSON
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Marshal(msg *Message) ([]byte, error) {
+	m := wsMessage{
+		ID:       msg.ID,
+		Topic:    msg.Topic,
+		Reply:    msg.Reply,
+		Headers:  msg.Header,
+		Time:     toUnixMilli(msg.Time),
+		Service:  msg.Service,
+		Identity: msg.Identity,
+	}
+	if rawJSONPayload(msg.Payload) {
+		m.Data = msg.Payload
+	} else {
+		text := string(msg.Payload)
+		if !utf8.Valid(msg.Payload) {
+			text = base64.StdEncoding.EncodeToString(msg.Payload)
+			m.Encoding = encodingBase64
+		}
+		data, err := json.Marshal(text)
+		if err != nil {
+			return nil, err
+		}
+		m.Data = data
+	}
+	return json.Marshal(m)
+}
+
+// rawJSONPayload 消息内容能否原样作为 data 且解码后不变：字符串与 null 解码时会被转换，
+// 编码时 JSON 会被压缩，因此只接受不是字符串或 null 的紧凑 JSON
+func rawJSONPayload(payload []byte) bool {
+	if len(payload) == 0 || payload[0] == '"' || string(payload) == "null" || !json.Valid(payload) {
+		return false
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, payload); err != nil {
+		return false
+	}
+	return bytes.Equal(buf.Bytes(), payload)
+}
+
+func (jsonCodec) Unmarshal(data []byte, msg *Message) error {
+	var m wsMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+
+	payload := []byte(m.Data)
+	if len(m.Data) > 0 && m.Data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(m.Data, &s); err != nil {
+			return err
+		}
+		payload = []byte(s)
+	} else if string(m.Data) == "null" {
+		payload = nil
+	}
+	switch m.Encoding {
+	case "":
+	case encodingBase64:
+		decoded, err := base64.StdEncoding.DecodeString(string(payload))
+		if err != nil {
+			return fmt.Errorf("invalid base64 data: %v", err)
+		}
+		payload = decoded
+	default:
+		return fmt.Errorf("unknown encoding %q", m.Encoding)
+	}
+
+	*msg = Message{
+		ID:       m.ID,
+		Service:  m.Service,
+		Identity: m.Identity,
+		Topic:    m.Topic,
+		Reply:    m.Reply,
+		Header:   m.Headers,
+		Payload:  payload,
+		Time:     fromUnixMilli(m.Time),
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package internal
+
+import "github.com/vmihailenco/msgpack/v5"
+
+// msgpackMessage 字段名与 JSON 协议相同，data 为二进制
+type msgpackMessage struct {
+	ID       string `msgpack:"id"`
+	Topic    string `msgpack:"topic"`
+	Data     []byte `msgpack:"data"`
+	Reply    string `msgpack:"reply,omitempty"`
+	Headers  Header `msgpack:"headers,omitempty"`
+	Time     int64  `msgpack:"time,omitempty"`
+	Service  string `msgpack:"service,omitempty"`
+	Identity string `msgpack:"identity,omitempty"`
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return ProtocolMsgpack
+}
+
+func (msgpackCodec) Binary() bool {
+	return true
+}
+
+func (msgpackCodec) Marshal(msg *Message) ([]byte, error) {
+	return msgpack.Marshal(&msgpackMessage{
+		ID:       msg.ID,
+		Topic:    msg.Topic,
+		Data:     msg.Payload,
+		Reply:    msg.Reply,
+		Headers:  msg.Header,
+		Time:     toUnixMilli(msg.Time),
+		Service:  msg.Service,
+		Identity: msg.Identity,
+	})
+}
+
+func (msgpackCodec) Unmarshal(data []byte, msg *Message) error {
+	var m msgpackMessage
+	if err := msgpack.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	*msg = Message{
+		ID:       m.ID,
+		Service:  m.Service,
+		Identity: m.Identity,
+		Topic:    m.Topic,
+		Reply:    m.Reply,
+		Header:   m.Headers,
+		Payload:  m.Data,
+		Time:     fromUnixMilli(m.Time),
+	}
+	return nil
+}
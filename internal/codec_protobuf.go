@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"errors"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var (
+	errProtobufMalformed = errors.New("malformed protobuf message")
+)
+
+// Message 的 Protobuf 字段编号，定义见 openapi/comet.proto
+const (
+	pbFieldID       protowire.Number = 1
+	pbFieldTopic    protowire.Number = 2
+	pbFieldData     protowire.Number = 3
+	pbFieldReply    protowire.Number = 4
+	pbFieldHeaders  protowire.Number = 5
+	pbFieldTime     protowire.Number = 6
+	pbFieldService  protowire.Number = 7
+	pbFieldIdentity protowire.Number = 8
+
+	pbFieldHeaderKey   protowire.Number = 1
+	pbFieldHeaderValue protowire.Number = 2
+)
+
+// protobufCodec 按 openapi/comet.proto 直接编解码，不依赖生成代码
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string {
+	return ProtocolProtobuf
+}
+
+func (protobufCodec) Binary() bool {
+	return true
+}
+
+func (protobufCodec) Marshal(msg *Message) ([]byte, error) {
+	var b []byte
+	b = appendPBString(b, pbFieldID, msg.ID)
+	b = appendPBString(b, pbFieldTopic, msg.Topic)
+	if len(msg.Payload) > 0 {
+		b = protowire.AppendTag(b, pbFieldData, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg.Payload)
+	}
+	b = appendPBString(b, pbFieldReply, msg.Reply)
+	for k, v := range msg.Header {
+		var entry []byte
+		entry = appendPBString(entry, pbFieldHeaderKey, k)
+		entry = appendPBString(entry, pbFieldHeaderValue, v)
+		b = protowire.AppendTag(b, pbFieldHeaders, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	if ms := toUnixMilli(msg.Time); ms != 0 {
+		b = protowire.AppendTag(b, pbFieldTime, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(ms))
+	}
+	b = appendPBString(b, pbFieldService, msg.Service)
+	b = appendPBString(b, pbFieldIdentity, msg.Identity)
+	return b, nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, msg *Message) error {
+	*msg = Message{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return errProtobufMalformed
+		}
+		data = data[n:]
+
+		switch {
+		case num == pbFieldTime && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return errProtobufMalformed
+			}
+			msg.Time = fromUnixMilli(int64(v))
+			data = data[n:]
+		case typ == protowire.BytesType && num >= pbFieldID && num <= pbFieldIdentity:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return errProtobufMalformed
+			}
+			if err := msg.setPBField(num, v); err != nil {
+				return err
+			}
+			data = data[n:]
+		default:
+			// 忽略未知字段，兼容新版本客户端
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return errProtobufMalformed
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+func (msg *Message) setPBField(num protowire.Number, v []byte) error {
+	switch num {
+	case pbFieldID:
+		msg.ID = string(v)
+	case pbFieldTopic:
+		msg.Topic = string(v)
+	case pbFieldData:
+		msg.Payload = append([]byte(nil), v...)
+	case pbFieldReply:
+		msg.Reply = string(v)
+	case pbFieldService:
+		msg.Service = string(v)
+	case pbFieldIdentity:
+		msg.Identity = string(v)
+	case pbFieldHeaders:
+		var key, value string
+		for len(v) > 0 {
+			num, typ, n := protowire.ConsumeTag(v)
+			if n < 0 {
+				return errProtobufMalformed
+			}
+			v = v[n:]
+			if typ != protowire.BytesType {
+				n = protowire.ConsumeFieldValue(num, typ, v)
+				if n < 0 {
+					return errProtobufMalformed
+				}
+				v = v[n:]
+				continue
+			}
+			s, n := protowire.ConsumeBytes(v)
+			if n < 0 {
+				return errProtobufMalformed
+			}
+			switch num {
+			case pbFieldHeaderKey:
+				key = string(s)
+			case pbFieldHeaderValue:
+				value = string(s)
+			}
+			v = v[n:]
+		}
+		if msg.Header == nil {
+			msg.Header = make(Header)
+		}
+		msg.Header[key] = value
+	}
+	return nil
+}
+
+func appendPBString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	msgs := []Message{
+		{},
+		{ID: "1", Topic: "chat.user.1000", Payload: []byte(`{"text":"hi"}`)},
+		{
+			ID:       "2",
+			Service:  "chat",
+			Identity: "1000",
+			Topic:    "chat.user.1000",
+			Reply:    "_INBOX.abc",
+			Header:   Header{HeaderContentType: "text/plain", HeaderCorrelationID: "42"},
+			Payload:  []byte("hello"),
+			Time:     time.Unix(1648006263, 123*int64(time.Millisecond)),
+		},
+		{ID: "3", Payload: []byte("\xff\x00\x80")},
+		{ID: "4", Payload: []byte(`"quoted"`)},
+		{ID: "5", Payload: []byte(`{"text": "hi"}`)},
+		{ID: "6", Payload: []byte("null")},
+	}
+	for _, protocol := range []string{ProtocolJSON, ProtocolProtobuf, ProtocolMsgpack} {
+		codec, err := GetCodec(protocol)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for _, msg := range msgs {
+			data, err := codec.Marshal(&msg)
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", protocol, err)
+			}
+			var got Message
+			if err := codec.Unmarshal(data, &got); err != nil {
+				t.Fatalf("%s: unexpected error: %v", protocol, err)
+			}
+			if len(got.Payload) == 0 && len(msg.Payload) == 0 {
+				got.Payload = msg.Payload
+			}
+			if !got.Time.Equal(msg.Time) {
+				t.Fatalf("%s: expected time %v, got %v", protocol, msg.Time, got.Time)
+			}
+			got.Time = msg.Time
+			if !reflect.DeepEqual(got, msg) {
+				t.Fatalf("%s: expected %+v, got %+v", protocol, msg, got)
+			}
+		}
+	}
+}
+
+func TestJSONCodecWSMessage(t *testing.T) {
+	codec, _ := GetCodec("JSON")
+	var msg Message
+	err := codec.Unmarshal([]byte(`{"id":"aa-basdf-cc","topic":"subscribe","data":["chat.user.1000"],"time":1648006263000}`), &msg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if msg.ID != "aa-basdf-cc" || msg.Topic != "subscribe" || string(msg.Payload) != `["chat.user.1000"]` {
+		t.Fatalf("Unexpected message %+v", msg)
+	}
+	if !msg.Time.Equal(time.Unix(1648006263, 0)) {
+		t.Fatalf("Unexpected time %v", msg.Time)
+	}
+
+	data, _ := codec.Marshal(&Message{ID: "1", Topic: "a", Payload: []byte("hello")})
+	if string(data) != `{"id":"1","topic":"a","data":"hello"}` {
+		t.Fatalf("Unexpected encoding %s", data)
+	}
+	data, _ = codec.Marshal(&Message{ID: "1", Topic: "a", Payload: []byte{0xff, 0x00}})
+	if string(data) != `{"id":"1","topic":"a","data":"/wA=","encoding":"base64"}` {
+		t.Fatalf("Unexpected encoding %s", data)
+	}
+	if err := codec.Unmarshal([]byte(`{"id":"1","topic":"a","data":"x","encoding":"gzip"}`), &msg); err == nil {
+		t.Fatalf("Expected an error for an unknown encoding")
+	}
+}
+
+func TestNegotiateProtocol(t *testing.T) {
+	tests := []struct {
+		header       string
+		subprotocols string
+		protocol     string
+		subprotocol  string
+		err          error
+	}{
+		{protocol: ProtocolJSON},
+		{header: "protobuf", protocol: ProtocolProtobuf},
+		{header: "MsgPack", subprotocols: "json", protocol: ProtocolMsgpack},
+		{subprotocols: "chat, msgpack, json", protocol: ProtocolMsgpack, subprotocol: "msgpack"},
+		{header: "xml", err: errUnknownProtocol},
+		{subprotocols: "xml", err: errUnknownProtocol},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/peer/conn", nil)
+		if test.header != "" {
+			r.Header.Set("Comet-Protocol", test.header)
+		}
+		if test.subprotocols != "" {
+			r.Header.Set("Sec-Websocket-Protocol", test.subprotocols)
+		}
+		codec, subprotocol, err := negotiateProtocol(r)
+		if !errors.Is(err, test.err) {
+			t.Fatalf("%+v: expected error %v, got %v", test, test.err, err)
+		}
+		if err != nil {
+			continue
+		}
+		if codec.Name() != test.protocol || subprotocol != test.subprotocol {
+			t.Fatalf("%+v: got %s and %q", test, codec.Name(), subprotocol)
+		}
+	}
+}
@@ -1,53 +1,226 @@
 package internal
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 var (
 	errServiceNotAvailable = errors.New("service not available")
+	errPeerUnauthorized    = errors.New("peer unauthorized")
+)
+
+// 客户端控制消息主题
+const (
+	PeerTopicSubscribe   = "subscribe"   // 订阅，data 为主题列表，如 ["chat.user.1000"]
+	PeerTopicUnsubscribe = "unsubscribe" // 取消订阅，data 为主题列表
+	PeerTopicAck         = "ack"         // 控制消息成功，data 为控制消息的主题列表
+	PeerTopicError       = "error"       // 控制消息失败，data 为 BaseResponse
 )
 
+// EventSlowConsumer 客户端积压事件，发布到 ServiceInfo.EventTopic(EventSlowConsumer)，data 为 SlowConsumerEvent
+const EventSlowConsumer = "slow_consumer"
+
+type CometOptions struct {
+	Peer            PeerOptions   // 客户端选项，OnSlowConsumer 在 Comet 发布事件后调用
+	ReconnectWindow time.Duration // 客户端下线后多久内上线视为重连，默认 30s
+	Store           ServiceStore  // 保存通过 CreateService 声明的业务系统，默认保存在内存
+}
+
 type Comet struct {
 	messaging Messaging
 	pool      cometPool
+	options   CometOptions
+	stats     cometStats
+	presence  *presenceTracker
 }
 
-func (c *Comet) NewPeer(conn io.ReadWriter, info PeerInfo) (Peer, error) {
+type cometStats struct {
+	slowConsumers uint64
+	evictionsMu   sync.Mutex
+	evictions     map[string]uint64
+}
+
+// CometStats 统计信息
+type CometStats struct {
+	NumPeers         int
+	NumServices      int
+	NumSlowConsumers uint64            // 客户端积压次数
+	Evictions        map[string]uint64 // 因积压被断开的客户端数，按原因统计
+}
+
+func NewComet(messaging Messaging) *Comet {
+	return NewCometWithOptions(messaging, CometOptions{})
+}
+
+func NewCometWithOptions(messaging Messaging, opts CometOptions) *Comet {
+	if opts.Store == nil {
+		opts.Store = NewMemoryServiceStore()
+	}
+	return &Comet{
+		messaging: messaging,
+		pool: cometPool{
+			peers:        make(map[string]Peer),
+			servicePeers: make(map[string]int),
+			services:     make(map[string]Service),
+		},
+		options: opts,
+		stats: cometStats{
+			evictions: make(map[string]uint64),
+		},
+		presence: newPresenceTracker(opts.ReconnectWindow),
+	}
+}
+
+// AuthPeer 检查连接协议并通过业务系统认证客户端，返回补全 ID、协议与业务系统用户信息的 PeerInfo；
+// 业务系统不存在时返回 errServiceNotAvailable，认证失败时返回 errPeerUnauthorized；ctx 结束时停止等待认证回调
+func (c *Comet) AuthPeer(ctx context.Context, info PeerInfo) (PeerInfo, error) {
+	codec, err := GetCodec(info.Protocol)
+	if err != nil {
+		return info, err
+	}
 	service, ok := c.pool.GetService(info.Service)
 	if !ok {
-		return nil, errServiceNotAvailable
+		return info, errServiceNotAvailable
+	}
+	// 升级前检查连接数，AddPeer 时再次检查
+	if max := service.Info().MaxPeers; max > 0 && c.pool.CountServicePeer(info.Service) >= max {
+		return info, errServiceFull
+	}
+	identity, err := service.Auth(ctx, AuthRequest{
+		ClientID: info.ClientID,
+		Token:    info.ServiceToken,
+		IP:       info.IP,
+	})
+	if errors.Is(err, ErrAuthUnavailable) {
+		return info, err
+	} else if err != nil {
+		return info, fmt.Errorf("%w: %v", errPeerUnauthorized, err)
+	}
+
+	if info.ID == "" {
+		info.ID = genId()
 	}
-	identity, err := service.Auth(info.ServiceToken)
+	info.Protocol = codec.Name()
+	info.ServiceIdentity = identity
+	return info, nil
+}
+
+// NewPeer 认证客户端并创建 Peer，需要取消认证时使用 AuthPeer
+func (c *Comet) NewPeer(conn io.ReadWriter, info PeerInfo) (Peer, error) {
+	info, err := c.AuthPeer(context.Background(), info)
 	if err != nil {
 		return nil, err
 	}
+	return c.newPeer(conn, info)
+}
 
-	info.ServiceIdentity = identity
-	peer := NewPeer(conn, info)
-	return peer, nil
+// newPeer 使用 AuthPeer 返回的 PeerInfo 创建 Peer
+func (c *Comet) newPeer(conn io.ReadWriter, info PeerInfo) (Peer, error) {
+	codec, err := GetCodec(info.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	service, ok := c.pool.GetService(info.Service)
+	if !ok {
+		return nil, errServiceNotAvailable
+	}
+	opts := c.options.Peer
+	opts.OnSlowConsumer = func(peer Peer, e SlowConsumerEvent) {
+		c.onSlowConsumer(service, peer, e)
+	}
+	return NewPeerWithOptions(conn, codec, info, opts), nil
 }
 
+// onSlowConsumer 统计并通知业务系统客户端积压
+func (c *Comet) onSlowConsumer(service Service, peer Peer, e SlowConsumerEvent) {
+	atomic.AddUint64(&c.stats.slowConsumers, 1)
+	if e.Policy == SlowConsumerDisconnect.String() {
+		c.stats.evictionsMu.Lock()
+		c.stats.evictions[e.Reason]++
+		c.stats.evictionsMu.Unlock()
+	}
+
+	payload, _ := json.Marshal(e)
+	info := peer.Info()
+	msg := Message{
+		ID:       genId(),
+		Service:  info.Service,
+		Identity: info.ServiceIdentity.Identity,
+		Topic:    EventSlowConsumer,
+		Header:   Header{HeaderPeerID: info.ID, HeaderContentType: "application/json"},
+		Payload:  payload,
+	}
+	c.messaging.Publish(service.Info().EventTopic(EventSlowConsumer), msg)
+
+	if c.options.Peer.OnSlowConsumer != nil {
+		c.options.Peer.OnSlowConsumer(peer, e)
+	}
+}
+
+// AddPeer 登记客户端并转发其消息，客户端断开时自动移除；失败时关闭客户端
 func (c *Comet) AddPeer(peer Peer) error {
 	service, ok := c.pool.GetService(peer.Info().Service)
 	if !ok {
+		closeRejected(peer, errServiceNotAvailable)
 		return errServiceNotAvailable
 	}
+	if err := c.pool.AddPeer(peer, service); err != nil {
+		closeRejected(peer, err)
+		return err
+	}
 	pubTopic, subTopic := service.GetPeerTopics(peer)
-	// TODO Unsubscribe
-	c.messaging.Subscribe(subTopic, func(topic string, message Message) {
+	subscriber, err := c.messaging.Subscribe(subTopic, func(topic string, message Message) {
 		peer.Send(&message)
 	})
+	if err != nil {
+		c.discardPeer(peer, err)
+		return err
+	}
+	// 订阅由客户端持有，断开时取消
+	if err := peer.Subscribe(subTopic, subscriber); err != nil {
+		subscriber.Unsubscribe()
+		c.discardPeer(peer, err)
+		return err
+	}
+
+	buf := make(chan *Message)
+	if err := peer.Receive(buf); err != nil {
+		c.discardPeer(peer, err)
+		return err
+	}
+	c.notifyPresence(service, peer, PresenceOnline, "")
 	go func() {
-		buf := make(chan *Message)
-		if err := peer.Receive(buf); err != nil {
-			return
-		}
+		defer c.removePeer(service, peer)
 
 		for {
 			select {
+			case <-peer.Done():
+				return
 			case msg := <-buf:
+				if msg.Topic == PeerTopicSubscribe || msg.Topic == PeerTopicUnsubscribe {
+					c.handlePeerControl(service, peer, msg)
+					continue
+				}
+				info := peer.Info()
+				msg.Service = info.Service
+				msg.Identity = info.ServiceIdentity.Identity
+				// 发送者信息由 Comet 设置，覆盖客户端提供的值；回复只能发给发送者自己
+				if msg.Header == nil {
+					msg.Header = make(Header)
+				}
+				msg.Header.Set(HeaderPeerID, info.ID)
+				msg.Header.Set(HeaderIdentity, info.ServiceIdentity.Identity)
+				msg.Reply = subTopic
 				if err := c.messaging.Publish(pubTopic, *msg); err != nil {
 					return
 				}
@@ -55,24 +228,176 @@ func (c *Comet) AddPeer(peer Peer) error {
 		}
 	}()
 
-	return c.pool.AddPeer(peer)
+	return nil
 }
 
+// handlePeerControl 处理客户端订阅、取消订阅，主题须在业务系统命名空间内，全部合法时才会执行
+func (c *Comet) handlePeerControl(service Service, peer Peer, msg *Message) {
+	var topics []string
+	if err := json.Unmarshal(msg.Payload, &topics); err != nil || len(topics) == 0 {
+		sendPeerError(peer, msg, http.StatusBadRequest, "data must be a non-empty list of topics")
+		return
+	}
+	info := service.Info()
+	for _, topic := range topics {
+		if err := info.ValidatePeerTopic(topic); err != nil {
+			sendPeerError(peer, msg, peerTopicErrorCode(err), err.Error())
+			return
+		}
+	}
+
+	var added []string
+	for _, topic := range topics {
+		if msg.Topic == PeerTopicUnsubscribe {
+			// 取消未订阅的主题不是错误
+			peer.UnSubscribe(topic)
+			continue
+		}
+
+		subscriber, err := c.messaging.Subscribe(topic, func(topic string, message Message) {
+			message.Topic = topic
+			peer.Send(&message)
+		})
+		if err == nil {
+			if err = peer.Subscribe(topic, subscriber); err != nil {
+				subscriber.Unsubscribe()
+			}
+		}
+		if errors.Is(err, errPeerAlreadySubscribed) {
+			continue
+		}
+		if err != nil {
+			// 撤销本次已执行的订阅，保证全部成功或全部失败
+			for _, topic := range added {
+				peer.UnSubscribe(topic)
+			}
+			sendPeerError(peer, msg, peerTopicErrorCode(err), err.Error())
+			return
+		}
+		added = append(added, topic)
+	}
+
+	ack := &Message{ID: genId(), Topic: PeerTopicAck, Payload: msg.Payload}
+	peer.Send(ack.withCorrelation(msg))
+}
+
+// peerTopicErrorCode 主题格式错误为 400，不在命名空间内为 403
+func peerTopicErrorCode(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidSubject):
+		return http.StatusBadRequest
+	case errors.Is(err, errTopicNotAllowed):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// sendPeerError 回复控制消息失败，peer 为客户端或业务系统连接
+func sendPeerError(peer interface{ Send(msg *Message) error }, msg *Message, code int, message string) {
+	payload, _ := json.Marshal(BaseResponse{Code: code, Message: message})
+	reply := &Message{ID: genId(), Topic: PeerTopicError, Payload: payload}
+	peer.Send(reply.withCorrelation(msg))
+}
+
+// withCorrelation 通过 Correlation-Id 消息头关联控制消息
+func (m *Message) withCorrelation(req *Message) *Message {
+	if m.Header == nil {
+		m.Header = make(Header)
+	}
+	m.Header.Set(HeaderCorrelationID, req.ID)
+	return m
+}
+
+// RemovePeer 移除客户端，关闭连接并取消其所有订阅，可重复调用；第一次调用时通知业务系统客户端下线
 func (c *Comet) RemovePeer(peer Peer) {
+	service, _ := c.pool.GetService(peer.Info().Service)
+	c.removePeer(service, peer)
+}
+
+// removePeer 业务系统已注销时 service 为调用者持有的业务系统，为 nil 时不通知下线
+func (c *Comet) removePeer(service Service, peer Peer) {
+	reason := PresenceReasonRemoved
+	select {
+	case <-peer.Done():
+		reason = peerCloseReason(peer)
+	default:
+	}
+	removed := c.pool.RemovePeer(peer.Info().ID)
+	peer.Close()
+	if removed && service != nil {
+		c.notifyPresence(service, peer, PresenceOffline, reason)
+	}
+}
+
+// discardPeer 移除未完成登记的客户端，不通知下线
+func (c *Comet) discardPeer(peer Peer, err error) {
 	c.pool.RemovePeer(peer.Info().ID)
+	closeRejected(peer, err)
+}
+
+// notifyPresence 发布客户端上下线事件，业务系统实现 PresenceNotifier 时同时通知
+func (c *Comet) notifyPresence(service Service, peer Peer, typ, reason string) {
+	info := peer.Info()
+	now := time.Now()
+	e := PresenceEvent{
+		Type:     typ,
+		PeerID:   info.ID,
+		ClientID: info.ClientID,
+		Identity: info.ServiceIdentity.Identity,
+		IP:       info.IP,
+		Reason:   reason,
+		Time:     toUnixMilli(now),
+	}
+	key := info.Service + "\x00" + e.key()
+	if typ == PresenceOffline {
+		c.presence.setOffline(key, now)
+	} else if c.presence.online(key, now) {
+		e.Type = PresenceReconnect
+	}
+
+	payload, _ := json.Marshal(e)
+	msg := Message{
+		ID:       genId(),
+		Service:  info.Service,
+		Identity: e.Identity,
+		Topic:    EventPresence,
+		Header:   Header{HeaderPeerID: info.ID, HeaderContentType: "application/json"},
+		Payload:  payload,
+	}
+	c.messaging.Publish(service.Info().EventTopic(EventPresence), msg)
+
+	if n, ok := service.(PresenceNotifier); ok {
+		n.NotifyPresence(e)
+	}
 }
 
 func (c *Comet) ListPeer(option ListPeerOption) []Peer {
 	return c.pool.ListPeer(option)
 }
 
+func (c *Comet) Stats() *CometStats {
+	st := &CometStats{
+		NumPeers:         c.pool.CountPeer(),
+		NumServices:      c.pool.CountService(),
+		NumSlowConsumers: atomic.LoadUint64(&c.stats.slowConsumers),
+		Evictions:        make(map[string]uint64),
+	}
+	c.stats.evictionsMu.Lock()
+	for reason, n := range c.stats.evictions {
+		st.Evictions[reason] = n
+	}
+	c.stats.evictionsMu.Unlock()
+	return st
+}
+
 func (c *Comet) CountPeer() int {
 	return c.pool.CountPeer()
 }
 
-func (c *Comet) NewService(service string) (Service, error) {
-	sess := NewService()
-	return sess, nil
+// NewService 按声明创建业务系统，需要调用 RegisterService 登记
+func (c *Comet) NewService(cfg ServiceConfig) (Service, error) {
+	return NewService(c.messaging, cfg)
 }
 
 func (c *Comet) NewServiceWorker(conn io.ReadWriter) (ServiceWorker, error) {
@@ -92,10 +417,94 @@ func (c *Comet) CountService() int {
 	return c.pool.CountService()
 }
 
+// RegisterService 登记业务系统，名称或主题前缀不合法时返回 errServiceInvalid，
+// 名称已存在或主题前缀与已有业务系统重叠时返回 errServiceExists
 func (c *Comet) RegisterService(service Service) error {
-	panic("not implemented")
+	if err := service.Info().Validate(); err != nil {
+		return err
+	}
+	if r, ok := service.(peerResolver); ok {
+		r.setPeerResolver(c.pool.GetPeer)
+	}
+	return c.pool.AddService(service)
+}
+
+// UnregisterService 注销业务系统，不再接受新连接；已有客户端与业务系统连接发送完待发送消息后以 1001 断开。
+// ctx 结束时直接断开并返回 ctx.Err()
+func (c *Comet) UnregisterService(ctx context.Context, name string) error {
+	service, ok := c.pool.GetService(name)
+	if !ok {
+		return errServiceNotAvailable
+	}
+	c.pool.RemoveService(service)
+
+	var wg sync.WaitGroup
+	for _, peer := range c.pool.ListPeer(ListPeerOption{Service: name}) {
+		wg.Add(1)
+		go func(peer Peer) {
+			defer wg.Done()
+			peer.Drain(ctx, websocket.CloseGoingAway, "service unregistered")
+			c.removePeer(service, peer)
+		}(peer)
+	}
+	wg.Wait()
+
+	if d, ok := service.(serviceDrainer); ok {
+		d.drain(ctx)
+	}
+	return ctx.Err()
+}
+
+// LoadServices 登记 Store 中保存的业务系统，用于启动时恢复；某个业务系统失败时继续登记其他业务系统并返回第一个错误
+func (c *Comet) LoadServices(ctx context.Context) error {
+	configs, err := c.options.Store.List(ctx)
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, cfg := range configs {
+		service, err := c.NewService(cfg)
+		if err == nil {
+			err = c.RegisterService(service)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("load service %q: %w", cfg.Name, err)
+		}
+	}
+	return firstErr
+}
+
+// serviceRollbackTimeout 保存失败时注销业务系统等待客户端断开的时长
+const serviceRollbackTimeout = 10 * time.Second
+
+// CreateService 创建、登记业务系统并保存到 Store，保存失败时注销
+func (c *Comet) CreateService(ctx context.Context, cfg ServiceConfig) (Service, error) {
+	service, err := c.NewService(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.RegisterService(service); err != nil {
+		return nil, err
+	}
+	if err := c.options.Store.Save(ctx, cfg); err != nil {
+		// ctx 可能已经结束，回滚时不使用 ctx，以免未断开已连接的客户端
+		rollback, cancel := context.WithTimeout(context.Background(), serviceRollbackTimeout)
+		defer cancel()
+		c.UnregisterService(rollback, cfg.Name)
+		return nil, err
+	}
+	return service, nil
+}
+
+// ListServiceConfig Store 中保存的业务系统声明
+func (c *Comet) ListServiceConfig(ctx context.Context) ([]ServiceConfig, error) {
+	return c.options.Store.List(ctx)
 }
 
-func (c *Comet) UnregisterService(service Service) {
-	panic("not implemented")
+// DeleteService 从 Store 删除并注销业务系统，见 UnregisterService
+func (c *Comet) DeleteService(ctx context.Context, name string) error {
+	if err := c.options.Store.Delete(ctx, name); err != nil && !errors.Is(err, errServiceNotAvailable) {
+		return err
+	}
+	return c.UnregisterService(ctx, name)
 }
@@ -0,0 +1,630 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type testService struct {
+	info    ServiceInfo
+	authErr error
+}
+
+func (s *testService) Info() ServiceInfo {
+	return s.info
+}
+
+func (s *testService) Auth(ctx context.Context, req AuthRequest) (ServiceIdentity, error) {
+	if s.authErr != nil {
+		return ServiceIdentity{}, s.authErr
+	}
+	return ServiceIdentity{Identity: req.Token}, nil
+}
+
+func (s *testService) GetPeerTopics(peer Peer) (publishTopic, subscribeTopic string) {
+	_, subTopic := s.info.Topics()
+	return subTopic, peerTopicPrefix + peer.Info().ID
+}
+
+func (s *testService) AuthWorker(token string) error        { return nil }
+func (s *testService) AddWorker(worker ServiceWorker) error { return nil }
+func (s *testService) RemoveWorker(worker ServiceWorker)    {}
+
+func newTestComet(t *testing.T) (*Comet, *standAloneImpl) {
+	m := NewStandAloneMessaging().(*standAloneImpl)
+	c := NewComet(m)
+	c.pool.AddService(&testService{info: ServiceInfo{Name: "chat"}})
+	return c, m
+}
+
+func nextFrame(t *testing.T, conn *testFrameConn) *Message {
+	t.Helper()
+	select {
+	case data := <-conn.writes:
+		msg := &Message{}
+		if err := (jsonCodec{}).Unmarshal(data, msg); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a frame")
+		return nil
+	}
+}
+
+func TestCometPeerSubscribe(t *testing.T) {
+	c, m := newTestComet(t)
+	conn := newTestFrameConn()
+	peer, err := c.NewPeer(conn, PeerInfo{Service: "chat", ServiceToken: "1000"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := c.AddPeer(peer); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	base := m.sublist.Count()
+
+	conn.reads <- []byte(`{"id":"s1","topic":"subscribe","data":["chat.user.1000","chat.room.*"]}`)
+	ack := nextFrame(t, conn)
+	if ack.Topic != PeerTopicAck || ack.Header.Get(HeaderCorrelationID) != "s1" {
+		t.Fatalf("Expected ack for s1, got %+v", ack)
+	}
+	// The peer also owns the subscription to its service topic.
+	if got := peer.Subscriptions(); len(got) != 3 || got[1] != "chat.room.*" || got[2] != "chat.user.1000" {
+		t.Fatalf("Unexpected subscriptions %v", got)
+	}
+	if m.sublist.Count() != base+2 {
+		t.Fatalf("Expected %d subscriptions, got %d", base+2, m.sublist.Count())
+	}
+
+	// Subscribing again is acknowledged without duplicating the subscription.
+	conn.reads <- []byte(`{"id":"s2","topic":"subscribe","data":["chat.user.1000"]}`)
+	if ack := nextFrame(t, conn); ack.Topic != PeerTopicAck {
+		t.Fatalf("Expected ack, got %+v", ack)
+	}
+	if m.sublist.Count() != base+2 {
+		t.Fatalf("Expected %d subscriptions, got %d", base+2, m.sublist.Count())
+	}
+
+	m.Publish("chat.room.1", Message{ID: "m1", Payload: []byte("hi")})
+	if msg := nextFrame(t, conn); msg.ID != "m1" || msg.Topic != "chat.room.1" {
+		t.Fatalf("Unexpected message %+v", msg)
+	}
+
+	conn.reads <- []byte(`{"id":"u1","topic":"unsubscribe","data":["chat.room.*","chat.other"]}`)
+	if ack := nextFrame(t, conn); ack.Topic != PeerTopicAck || ack.Header.Get(HeaderCorrelationID) != "u1" {
+		t.Fatalf("Expected ack for u1, got %+v", ack)
+	}
+	if m.sublist.Count() != base+1 {
+		t.Fatalf("Expected %d subscriptions, got %d", base+1, m.sublist.Count())
+	}
+
+	peer.Close()
+	if m.sublist.Count() != 0 {
+		t.Fatalf("Expected no subscriptions after close, got %d", m.sublist.Count())
+	}
+}
+
+func TestCometPeerSubscribeErrors(t *testing.T) {
+	c, m := newTestComet(t)
+	conn := newTestFrameConn()
+	peer, _ := c.NewPeer(conn, PeerInfo{Service: "chat"})
+	c.AddPeer(peer)
+	defer peer.Close()
+	base := m.sublist.Count()
+
+	tests := []struct {
+		frame string
+		code  int
+	}{
+		{`{"id":"e1","topic":"subscribe","data":"chat.user.1000"}`, 400},
+		{`{"id":"e2","topic":"subscribe","data":[]}`, 400},
+		{`{"id":"e3","topic":"subscribe","data":["chat.user.1000","news.1"]}`, 403},
+		{`{"id":"e4","topic":"subscribe","data":["$.service.chat.sub"]}`, 403},
+		{`{"id":"e5","topic":"subscribe","data":["*.user"]}`, 403},
+		{`{"id":"e6","topic":"unsubscribe","data":["chat..user"]}`, 400},
+	}
+	for _, test := range tests {
+		conn.reads <- []byte(test.frame)
+		msg := nextFrame(t, conn)
+		var resp BaseResponse
+		json.Unmarshal(msg.Payload, &resp)
+		if msg.Topic != PeerTopicError || resp.Code != test.code {
+			t.Fatalf("%s: expected error %d, got %+v", test.frame, test.code, msg)
+		}
+	}
+	if m.sublist.Count() != base {
+		t.Fatalf("Expected no new subscriptions, got %d", m.sublist.Count()-base)
+	}
+}
+
+// failingMessaging 订阅 fail 主题时返回错误
+type failingMessaging struct {
+	Messaging
+	fail string
+}
+
+func (m failingMessaging) Subscribe(topicPattern string, handler SubscribeHandler, opts ...SubscribeOption) (Subscriber, error) {
+	if topicPattern == m.fail {
+		return nil, errors.New("subscribe failed")
+	}
+	return m.Messaging.Subscribe(topicPattern, handler, opts...)
+}
+
+func TestCometPeerSubscribeRollback(t *testing.T) {
+	m := NewStandAloneMessaging().(*standAloneImpl)
+	c := NewComet(failingMessaging{Messaging: m, fail: "chat.fail"})
+	c.pool.AddService(&testService{info: ServiceInfo{Name: "chat"}})
+	conn := newTestFrameConn()
+	peer, _ := c.NewPeer(conn, PeerInfo{Service: "chat"})
+	c.AddPeer(peer)
+	defer peer.Close()
+	base := m.sublist.Count()
+
+	conn.reads <- []byte(`{"id":"s1","topic":"subscribe","data":["chat.a","chat.fail"]}`)
+	msg := nextFrame(t, conn)
+	var resp BaseResponse
+	json.Unmarshal(msg.Payload, &resp)
+	if msg.Topic != PeerTopicError || resp.Code != 500 || msg.Header.Get(HeaderCorrelationID) != "s1" {
+		t.Fatalf("Expected error 500 for s1, got %+v", msg)
+	}
+	if m.sublist.Count() != base || len(peer.Subscriptions()) != 1 {
+		t.Fatalf("Expected the subscriptions to be rolled back, got %v", peer.Subscriptions())
+	}
+}
+
+func TestCometPeerReleased(t *testing.T) {
+	c, m := newTestComet(t)
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 2000; i++ {
+		conn := newTestFrameConn()
+		peer, err := c.NewPeer(conn, PeerInfo{Service: "chat"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := c.AddPeer(peer); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		conn.reads <- []byte(`{"id":"s1","topic":"subscribe","data":["chat.user.1000"]}`)
+		nextFrame(t, conn)
+
+		// Half of the peers are removed by Comet, the others disconnect.
+		if i%2 == 0 {
+			c.RemovePeer(peer)
+		} else {
+			conn.Close()
+			<-peer.Done()
+		}
+	}
+
+	waitFor(t, func() bool { return c.CountPeer() == 0 })
+	if m.sublist.Count() != 0 {
+		t.Fatalf("Expected no subscriptions, got %d", m.sublist.Count())
+	}
+	waitFor(t, func() bool { return runtime.NumGoroutine() <= before })
+
+	// Messages to released peers are not delivered.
+	if err := m.Publish("chat.user.1000", Message{}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestCometPeerDrainUnderLoad(t *testing.T) {
+	c, m := newTestComet(t)
+	conn := &testCloseCodeConn{testFrameConn: newTestFrameConn(), code: make(chan int, 1)}
+	peer, _ := c.NewPeer(conn, PeerInfo{Service: "chat"})
+	c.AddPeer(peer)
+	conn.reads <- []byte(`{"id":"s1","topic":"subscribe","data":["chat.room.1"]}`)
+	nextFrame(t, conn.testFrameConn)
+
+	// A slow writer and publishers that never pause.
+	go func() {
+		for {
+			select {
+			case <-conn.writes:
+				time.Sleep(time.Millisecond)
+			case <-conn.closed:
+				return
+			}
+		}
+	}()
+	stop := make(chan struct{})
+	defer close(stop)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					m.Publish("chat.room.1", Message{Payload: []byte("hi")})
+					time.Sleep(100 * time.Microsecond)
+				}
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := peer.Drain(ctx, websocket.CloseGoingAway, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if code := <-conn.code; code != websocket.CloseGoingAway {
+		t.Fatalf("Expected close code %d, got %d", websocket.CloseGoingAway, code)
+	}
+}
+
+func TestCometSlowConsumer(t *testing.T) {
+	m := NewStandAloneMessaging().(*standAloneImpl)
+	c := NewCometWithOptions(m, CometOptions{Peer: PeerOptions{MaxPending: 1, SlowConsumer: SlowConsumerDisconnect}})
+	service := &testService{info: ServiceInfo{Name: "chat"}}
+	c.pool.AddService(service)
+
+	events := make(chan Message, 1)
+	m.Subscribe(service.info.EventTopic(EventSlowConsumer), func(topic string, message Message) {
+		events <- message
+	})
+
+	conn := newTestFrameConn()
+	conn.writes = make(chan []byte) // never drained
+	peer, _ := c.NewPeer(conn, PeerInfo{Service: "chat", ServiceToken: "1000"})
+	c.AddPeer(peer)
+	_, subTopic := service.GetPeerTopics(peer)
+	for i := 0; i < 3; i++ {
+		m.Publish(subTopic, Message{})
+	}
+
+	msg := <-events
+	var e SlowConsumerEvent
+	json.Unmarshal(msg.Payload, &e)
+	if msg.Topic != EventSlowConsumer || msg.Identity != "1000" || e.PeerID != peer.Info().ID || e.Reason != SlowConsumerMaxPending {
+		t.Fatalf("Unexpected event %+v: %+v", msg, e)
+	}
+	<-peer.Done()
+	waitFor(t, func() bool { return c.CountPeer() == 0 })
+	if st := c.Stats(); st.NumSlowConsumers != 1 || st.Evictions[SlowConsumerMaxPending] != 1 {
+		t.Fatalf("Unexpected stats %+v", st)
+	}
+}
+
+func TestCometSlowConsumerWorker(t *testing.T) {
+	m := NewStandAloneMessaging()
+	c := NewCometWithOptions(m, CometOptions{Peer: PeerOptions{MaxPending: 1, SlowConsumer: SlowConsumerDisconnect}})
+	service, _ := c.NewService(ServiceConfig{Name: "chat", Auth: AuthConfig{Mode: AuthModeHMAC, Secret: "secret"}})
+	c.RegisterService(service)
+	workerConn := newTestFrameConn()
+	worker, _ := c.NewServiceWorker(workerConn)
+	if err := service.AddWorker(worker); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer workerConn.Close()
+
+	conn := newTestFrameConn()
+	conn.writes = make(chan []byte) // never drained
+	token := SignHMACToken([]byte("secret"), "1000", time.Now().Add(time.Minute))
+	peer, _ := c.NewPeer(conn, PeerInfo{Service: "chat", ServiceToken: token})
+	c.AddPeer(peer)
+	_, subTopic := service.GetPeerTopics(peer)
+	for i := 0; i < 3; i++ {
+		m.Publish(subTopic, Message{})
+	}
+
+	// The worker receives the online event before the eviction.
+	for {
+		msg := nextFrame(t, workerConn)
+		if msg.Topic != EventSlowConsumer {
+			continue
+		}
+		var e SlowConsumerEvent
+		json.Unmarshal(msg.Payload, &e)
+		if e.PeerID != peer.Info().ID || msg.Identity != "1000" {
+			t.Fatalf("Unexpected event %+v: %+v", msg, e)
+		}
+		break
+	}
+}
+
+func TestCometServiceWorkerRoundTrip(t *testing.T) {
+	c, _ := newTestComet(t)
+	service, _ := c.NewService(ServiceConfig{Name: "news", Auth: AuthConfig{Mode: AuthModeHMAC, Secret: "secret"}})
+	c.RegisterService(service)
+	workerConn := newTestFrameConn()
+	worker, _ := c.NewServiceWorker(workerConn)
+	if err := service.AddWorker(worker); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer workerConn.Close()
+
+	conn := newTestFrameConn()
+	token := SignHMACToken([]byte("secret"), "1000", time.Now().Add(time.Minute))
+	peer, _ := c.NewPeer(conn, PeerInfo{Service: "news", ServiceToken: token})
+	if err := c.AddPeer(peer); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer c.RemovePeer(peer)
+
+	// The worker receives the peer's message along with the sender; replies go
+	// back to the sender whatever reply topic the client asked for.
+	conn.reads <- []byte(`{"id":"m1","topic":"news.comment","reply":"$.peer.victim","data":"hi"}`)
+	var msg *Message
+	for msg == nil || msg.Topic == EventPresence {
+		msg = nextFrame(t, workerConn)
+	}
+	peerID := msg.Header.Get(HeaderPeerID)
+	if msg.ID != "m1" || msg.Topic != "news.comment" || peerID != peer.Info().ID || msg.Identity != "1000" ||
+		msg.Reply != peerTopicPrefix+peerID {
+		t.Fatalf("Unexpected message %+v", msg)
+	}
+
+	// The worker answers on the peer topic, or on the reply topic when no topic is given.
+	workerConn.reads <- []byte(`{"id":"r1","topic":"$.peer.` + peerID + `","data":"hello"}`)
+	if msg := nextFrame(t, conn); msg.ID != "r1" || string(msg.Payload) != "hello" {
+		t.Fatalf("Unexpected message %+v", msg)
+	}
+	workerConn.reads <- []byte(`{"id":"r2","topic":"","reply":"` + msg.Reply + `","data":"again"}`)
+	if msg := nextFrame(t, conn); msg.ID != "r2" || msg.Topic != peerTopicPrefix+peerID || msg.Reply != "" {
+		t.Fatalf("Unexpected message %+v", msg)
+	}
+
+	// Topics outside the service namespace are rejected.
+	workerConn.reads <- []byte(`{"id":"r3","topic":"chat.room.1","data":"x"}`)
+	msg = nextFrame(t, workerConn)
+	var resp BaseResponse
+	json.Unmarshal(msg.Payload, &resp)
+	if msg.Topic != PeerTopicError || resp.Code != 403 || msg.Header.Get(HeaderCorrelationID) != "r3" {
+		t.Fatalf("Expected error 403 for r3, got %+v", msg)
+	}
+}
+
+func TestCometServiceWorkerRemoved(t *testing.T) {
+	c, m := newTestComet(t)
+	service, _ := c.NewService(ServiceConfig{Name: "news", Auth: AuthConfig{Mode: AuthModeHMAC, Secret: "secret"}})
+	c.RegisterService(service)
+	base := m.sublist.Count()
+	groups := func() int {
+		m.queuesMu.RLock()
+		defer m.queuesMu.RUnlock()
+		return len(m.queues)
+	}
+	workerConn := newTestFrameConn()
+	worker, _ := c.NewServiceWorker(workerConn)
+	if err := service.AddWorker(worker); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := m.sublist.Count() - base; n != 3 || groups() != 3 {
+		t.Fatalf("Expected 3 queue subscriptions, got %d in %d groups", n, groups())
+	}
+
+	// The worker leaves its queue groups when the connection closes, without RemoveWorker.
+	workerConn.Close()
+	<-worker.Done()
+	waitFor(t, func() bool { return m.sublist.Count() == base })
+	if sessions := service.(*serviceImpl).servicePool.CountSession(); groups() != 0 || sessions != 0 {
+		t.Fatalf("Expected the worker to be removed, got %d groups and %d sessions", groups(), sessions)
+	}
+}
+
+func TestCometServiceWorkerIsolation(t *testing.T) {
+	c, m := newTestComet(t)
+	hmacAuth := AuthConfig{Mode: AuthModeHMAC, Secret: "secret"}
+	news, _ := c.NewService(ServiceConfig{Name: "news", Auth: hmacAuth})
+	c.RegisterService(news)
+	sports, _ := c.NewService(ServiceConfig{Name: "sports", Auth: hmacAuth})
+	c.RegisterService(sports)
+	workerConn := newTestFrameConn()
+	worker, _ := c.NewServiceWorker(workerConn)
+	if err := news.AddWorker(worker); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer workerConn.Close()
+
+	conn := newTestFrameConn()
+	token := SignHMACToken([]byte("secret"), "1000", time.Now().Add(time.Minute))
+	peer, _ := c.NewPeer(conn, PeerInfo{Service: "sports", ServiceToken: token})
+	if err := c.AddPeer(peer); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer c.RemovePeer(peer)
+
+	expectError := func(id string) {
+		t.Helper()
+		msg := nextFrame(t, workerConn)
+		var resp BaseResponse
+		json.Unmarshal(msg.Payload, &resp)
+		if msg.Topic != PeerTopicError || resp.Code != 403 || msg.Header.Get(HeaderCorrelationID) != id {
+			t.Fatalf("Expected error 403 for %s, got %+v", id, msg)
+		}
+	}
+	// A worker of news can reach neither the peers of sports nor inboxes it was not given.
+	workerConn.reads <- []byte(`{"id":"r1","topic":"$.peer.` + peer.Info().ID + `","data":"x"}`)
+	expectError("r1")
+	workerConn.reads <- []byte(`{"id":"r2","topic":"$.peer.*","data":"x"}`)
+	expectError("r2")
+	inbox := NewInbox()
+	workerConn.reads <- []byte(`{"id":"r3","topic":"` + inbox + `","data":"x"}`)
+	expectError("r3")
+	select {
+	case data := <-conn.writes:
+		t.Fatalf("Unexpected frame %s", data)
+	default:
+	}
+
+	// Requests sent to the service can be answered on their reply topic.
+	replies := make(chan Message, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		reply, _ := m.Request(ctx, "$.service.news.sub", Message{ID: "q1"})
+		replies <- reply
+	}()
+	msg := nextFrame(t, workerConn)
+	if msg.ID != "q1" || !strings.HasPrefix(msg.Reply, InboxPrefix) {
+		t.Fatalf("Unexpected request %+v", msg)
+	}
+	workerConn.reads <- []byte(`{"id":"a1","reply":"` + msg.Reply + `","data":"ok"}`)
+	if reply := <-replies; reply.ID != "a1" {
+		t.Fatalf("Unexpected reply %+v", reply)
+	}
+}
+
+func TestCometRegisterService(t *testing.T) {
+	c, _ := newTestComet(t)
+	hmacAuth := AuthConfig{Mode: AuthModeHMAC, Secret: "secret"}
+	register := func(cfg ServiceConfig) error {
+		service, err := c.NewService(cfg)
+		if err != nil {
+			return err
+		}
+		return c.RegisterService(service)
+	}
+
+	if err := register(ServiceConfig{Name: "app", Namespace: "app.chat", Auth: hmacAuth, MaxPeers: 1}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tests := []struct {
+		cfg ServiceConfig
+		err error
+	}{
+		{ServiceConfig{Name: "app", Namespace: "app.news", Auth: hmacAuth}, errServiceExists},
+		{ServiceConfig{Name: "room", Namespace: "chat.room", Auth: hmacAuth}, errServiceExists},
+		{ServiceConfig{Name: "apps", Namespace: "app", Auth: hmacAuth}, errServiceExists},
+		{ServiceConfig{Name: "", Auth: hmacAuth}, errServiceInvalid},
+		{ServiceConfig{Name: "a.b", Auth: hmacAuth}, errServiceInvalid},
+		{ServiceConfig{Name: strings.Repeat("a", 65), Auth: hmacAuth}, errServiceInvalid},
+		{ServiceConfig{Name: "long", Namespace: strings.Repeat("a", 256), Auth: hmacAuth}, errServiceInvalid},
+		{ServiceConfig{Name: "sys", Namespace: "$.service", Auth: hmacAuth}, errServiceInvalid},
+		{ServiceConfig{Name: "inbox", Namespace: "_INBOX.x", Auth: hmacAuth}, errServiceInvalid},
+		{ServiceConfig{Name: "news", Namespace: "news.*", Auth: hmacAuth}, errServiceInvalid},
+		{ServiceConfig{Name: "news", Auth: AuthConfig{Mode: AuthModeHMAC}}, errServiceInvalid},
+	}
+	for _, test := range tests {
+		if err := register(test.cfg); !errors.Is(err, test.err) {
+			t.Fatalf("%+v: expected %v, got %v", test.cfg, test.err, err)
+		}
+	}
+	if err := register(ServiceConfig{Name: strings.Repeat("a", 64), Namespace: "long", Auth: hmacAuth}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	service, _ := c.GetService("app")
+	if err := service.Info().ValidatePeerTopic("app.chat.user.1000"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := service.Info().ValidatePeerTopic("app.news"); !errors.Is(err, errTopicNotAllowed) {
+		t.Fatalf("Expected errTopicNotAllowed, got %v", err)
+	}
+
+	token := SignHMACToken([]byte("secret"), "1000", time.Now().Add(time.Minute))
+	peer, err := c.NewPeer(newTestFrameConn(), PeerInfo{Service: "app", ServiceToken: token})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := c.AddPeer(peer); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer c.RemovePeer(peer)
+	if _, err := c.AuthPeer(context.Background(), PeerInfo{Service: "app", ServiceToken: token}); !errors.Is(err, errServiceFull) {
+		t.Fatalf("Expected errServiceFull, got %v", err)
+	}
+
+	// Peers rejected by AddPeer are closed instead of leaking their write loop.
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		conn := &testCloseCodeConn{testFrameConn: newTestFrameConn(), code: make(chan int, 1)}
+		rejected, err := c.newPeer(conn, PeerInfo{ID: genId(), Service: "app"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := c.AddPeer(rejected); !errors.Is(err, errServiceFull) {
+			t.Fatalf("Expected errServiceFull, got %v", err)
+		}
+		select {
+		case code := <-conn.code:
+			if code != websocket.CloseTryAgainLater {
+				t.Fatalf("Expected close code %d, got %d", websocket.CloseTryAgainLater, code)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the rejected peer to be closed")
+		}
+	}
+	waitFor(t, func() bool { return runtime.NumGoroutine() <= before })
+	if c.CountPeer() != 1 {
+		t.Fatalf("Expected 1 peer, got %d", c.CountPeer())
+	}
+}
+
+func TestCometUnregisterService(t *testing.T) {
+	c, m := newTestComet(t)
+	service, err := c.NewService(ServiceConfig{Name: "news", Auth: AuthConfig{Mode: AuthModeHMAC, Secret: "secret"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := c.RegisterService(service); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	base := m.sublist.Count()
+
+	events := make(chan Message, 4)
+	m.Subscribe(service.Info().EventTopic(EventPresence), func(topic string, message Message) {
+		events <- message
+	})
+
+	conn := &testCloseCodeConn{testFrameConn: newTestFrameConn(), code: make(chan int, 1)}
+	token := SignHMACToken([]byte("secret"), "1000", time.Now().Add(time.Minute))
+	peer, _ := c.NewPeer(conn, PeerInfo{Service: "news", ServiceToken: token})
+	if err := c.AddPeer(peer); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	<-events
+	worker, _ := c.NewServiceWorker(newTestFrameConn())
+	if err := service.AddWorker(worker); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Peers of other services are not affected.
+	other, _ := c.NewPeer(newTestFrameConn(), PeerInfo{Service: "chat"})
+	c.AddPeer(other)
+	defer c.RemovePeer(other)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.UnregisterService(ctx, "news"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if code := <-conn.code; code != websocket.CloseGoingAway {
+		t.Fatalf("Expected close code %d, got %d", websocket.CloseGoingAway, code)
+	}
+	<-worker.Done()
+	if _, ok := c.GetService("news"); ok || c.CountPeer() != 1 {
+		t.Fatalf("Expected the service and its peers to be removed, got %d peers", c.CountPeer())
+	}
+	// The presence subscription of the test and the subscription of the other peer remain.
+	if n := m.sublist.Count() - base; n != 2 {
+		t.Fatalf("Expected 2 subscriptions, got %d", n)
+	}
+	var e PresenceEvent
+	json.Unmarshal((<-events).Payload, &e)
+	if e.Type != PresenceOffline || e.Reason != PresenceReasonShutdown {
+		t.Fatalf("Unexpected presence event %+v", e)
+	}
+
+	if err := c.UnregisterService(ctx, "news"); !errors.Is(err, errServiceNotAvailable) {
+		t.Fatalf("Expected errServiceNotAvailable, got %v", err)
+	}
+
+	// A concurrent AddPeer that looked up the service before it was unregistered
+	// does not add the peer afterwards.
+	late := NewPeer(newTestFrameConn(), jsonCodec{}, PeerInfo{ID: genId(), Service: "news"})
+	defer late.Close()
+	if err := c.pool.AddPeer(late, service); !errors.Is(err, errServiceNotAvailable) {
+		t.Fatalf("Expected errServiceNotAvailable, got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy 订阅者投递队列已满时的处理策略
+type OverflowPolicy int
+
+const (
+	OverflowDropNewest OverflowPolicy = iota // 丢弃新消息
+	OverflowDropOldest                       // 丢弃最早的消息
+	OverflowBlock                            // 阻塞发布者，直到队列有空位或取消订阅
+	OverflowDisconnect                       // 丢弃新消息并取消订阅
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDropNewest:
+		return "drop_newest"
+	case OverflowDropOldest:
+		return "drop_oldest"
+	case OverflowBlock:
+		return "block"
+	case OverflowDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// defaultMaxPending 订阅者投递队列的默认长度
+const defaultMaxPending = 1024
+
+// WithMaxPending 指定订阅者投递队列长度
+func WithMaxPending(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.maxPending = n
+	}
+}
+
+// WithOverflowPolicy 指定投递队列已满时的处理策略，默认丢弃新消息
+func WithOverflowPolicy(policy OverflowPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.overflow = policy
+	}
+}
+
+// WithOnDisconnect 指定因 OverflowDisconnect 被取消订阅时的回调
+func WithOnDisconnect(fn func()) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.onDisconnect = fn
+	}
+}
+
+type delivery struct {
+	topic string
+	msg   Message
+}
+
+// mailbox 订阅者的有界投递队列，由单个 goroutine 按入队顺序调用 handler
+type mailbox struct {
+	mu       sync.Mutex // 保证 OverflowDropOldest 出队入队的原子性
+	queue    chan delivery
+	done     chan struct{}
+	draining chan struct{} // 关闭后投递完已入队的消息即停止
+	released chan struct{} // 正在入队的消息被丢弃时通知 drain 重新检查 inFlight
+	policy   OverflowPolicy
+	dropped  uint64
+	inFlight *int64 // 排队及处理中的消息数
+
+	closeOnce sync.Once
+	drainOnce sync.Once
+	overflow  func() // OverflowDisconnect 时调用
+}
+
+func newMailbox(size int, policy OverflowPolicy, inFlight *int64, overflow func()) *mailbox {
+	return &mailbox{
+		queue:    make(chan delivery, size),
+		done:     make(chan struct{}),
+		draining: make(chan struct{}),
+		released: make(chan struct{}, 1),
+		policy:   policy,
+		inFlight: inFlight,
+		overflow: overflow,
+	}
+}
+
+// run 投递消息，直到 close 被调用或 drain 后已入队的消息投递完毕
+func (b *mailbox) run(handler SubscribeHandler) {
+	for {
+		select {
+		case d := <-b.queue:
+			handler(d.topic, d.msg)
+			atomic.AddInt64(b.inFlight, -1)
+		case <-b.draining:
+			// 等待正在入队的消息入队或被丢弃，调用者已停止向 mailbox 发布新消息
+			for atomic.LoadInt64(b.inFlight) > 0 {
+				select {
+				case d := <-b.queue:
+					handler(d.topic, d.msg)
+					atomic.AddInt64(b.inFlight, -1)
+				case <-b.released:
+				case <-b.done:
+					return
+				}
+			}
+			b.close()
+			return
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// push 将消息入队，返回消息是否入队
+func (b *mailbox) push(topic string, msg Message) bool {
+	d := delivery{topic: topic, msg: msg}
+	select {
+	case <-b.done:
+		return false
+	default:
+	}
+
+	switch b.policy {
+	case OverflowBlock:
+		atomic.AddInt64(b.inFlight, 1)
+		select {
+		case b.queue <- d:
+			return true
+		case <-b.done:
+			b.release()
+			return false
+		}
+	case OverflowDropOldest:
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		atomic.AddInt64(b.inFlight, 1)
+		for {
+			select {
+			case b.queue <- d:
+				return true
+			default:
+			}
+			select {
+			case <-b.queue:
+				b.release()
+				atomic.AddUint64(&b.dropped, 1)
+			default:
+			}
+		}
+	default:
+		atomic.AddInt64(b.inFlight, 1)
+		select {
+		case b.queue <- d:
+			return true
+		default:
+		}
+		b.release()
+		atomic.AddUint64(&b.dropped, 1)
+		if b.policy == OverflowDisconnect && b.overflow != nil {
+			b.overflow()
+		}
+		return false
+	}
+}
+
+// release 未投递的消息离开队列，唤醒等待入队完成的 drain
+func (b *mailbox) release() {
+	atomic.AddInt64(b.inFlight, -1)
+	select {
+	case b.released <- struct{}{}:
+	default:
+	}
+}
+
+// close 停止投递，未投递的消息被丢弃
+func (b *mailbox) close() {
+	b.closeOnce.Do(func() {
+		close(b.done)
+	})
+}
+
+// drain 投递完已入队的消息后停止，返回的通道在停止后关闭
+func (b *mailbox) drain() <-chan struct{} {
+	b.drainOnce.Do(func() {
+		close(b.draining)
+	})
+	return b.done
+}
+
+func (b *mailbox) pending() int {
+	return len(b.queue)
+}
+
+func (b *mailbox) droppedCount() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingHandler returns a handler that records message IDs and blocks
+// until release is closed, and a channel signalled on the first delivery.
+func blockingHandler(release chan struct{}) (SubscribeHandler, chan struct{}, func() []string) {
+	var mu sync.Mutex
+	var ids []string
+	started := make(chan struct{})
+	var once sync.Once
+	handler := func(topic string, message Message) {
+		once.Do(func() { close(started) })
+		<-release
+		mu.Lock()
+		ids = append(ids, message.ID)
+		mu.Unlock()
+	}
+	return handler, started, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ids...)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDeliveryOrdered(t *testing.T) {
+	m := NewStandAloneMessaging()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	received := make([][]int, 3)
+	for i := range received {
+		i := i
+		if _, err := m.Subscribe("a.b", func(topic string, message Message) {
+			n, _ := strconv.Atoi(message.ID)
+			mu.Lock()
+			received[i] = append(received[i], n)
+			mu.Unlock()
+			wg.Done()
+		}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	wg.Add(3 * 1000)
+	for i := 0; i < 1000; i++ {
+		if err := m.Publish("a.b", Message{ID: strconv.Itoa(i)}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	wg.Wait()
+	for i, r := range received {
+		for j, n := range r {
+			if n != j {
+				t.Fatalf("Subscriber %d received message %d at position %d", i, n, j)
+			}
+		}
+	}
+}
+
+func TestDeliveryDropNewest(t *testing.T) {
+	m := NewStandAloneMessaging()
+	release := make(chan struct{})
+	handler, started, ids := blockingHandler(release)
+	sub, _ := m.Subscribe("a", handler, WithMaxPending(2))
+
+	m.Publish("a", Message{ID: "0"})
+	<-started
+	for i := 1; i <= 5; i++ {
+		m.Publish("a", Message{ID: strconv.Itoa(i)})
+	}
+	if sub.Pending() != 2 || sub.Dropped() != 3 {
+		t.Fatalf("Expected 2 pending and 3 dropped, got %d and %d", sub.Pending(), sub.Dropped())
+	}
+	close(release)
+	waitFor(t, func() bool { return len(ids()) == 3 })
+	if got := ids(); got[1] != "1" || got[2] != "2" {
+		t.Fatalf("Expected the oldest messages to be kept, got %v", got)
+	}
+}
+
+func TestDeliveryDropOldest(t *testing.T) {
+	m := NewStandAloneMessaging()
+	release := make(chan struct{})
+	handler, started, ids := blockingHandler(release)
+	sub, _ := m.Subscribe("a", handler, WithMaxPending(2), WithOverflowPolicy(OverflowDropOldest))
+
+	m.Publish("a", Message{ID: "0"})
+	<-started
+	for i := 1; i <= 5; i++ {
+		m.Publish("a", Message{ID: strconv.Itoa(i)})
+	}
+	if sub.Pending() != 2 || sub.Dropped() != 3 {
+		t.Fatalf("Expected 2 pending and 3 dropped, got %d and %d", sub.Pending(), sub.Dropped())
+	}
+	close(release)
+	waitFor(t, func() bool { return len(ids()) == 3 })
+	if got := ids(); got[1] != "4" || got[2] != "5" {
+		t.Fatalf("Expected the newest messages to be kept, got %v", got)
+	}
+}
+
+func TestDeliveryBlock(t *testing.T) {
+	m := NewStandAloneMessaging()
+	release := make(chan struct{})
+	handler, started, ids := blockingHandler(release)
+	sub, _ := m.Subscribe("a", handler, WithMaxPending(1), WithOverflowPolicy(OverflowBlock))
+
+	m.Publish("a", Message{ID: "0"})
+	<-started
+	m.Publish("a", Message{ID: "1"})
+
+	published := make(chan struct{})
+	go func() {
+		m.Publish("a", Message{ID: "2"})
+		close(published)
+	}()
+	select {
+	case <-published:
+		t.Fatalf("Expected Publish to block while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-published
+	waitFor(t, func() bool { return len(ids()) == 3 })
+	if sub.Dropped() != 0 {
+		t.Fatalf("Expected no dropped messages, got %d", sub.Dropped())
+	}
+
+	// Unsubscribing releases a blocked publisher.
+	block := make(chan struct{})
+	handler, started, _ = blockingHandler(block)
+	sub, _ = m.Subscribe("b", handler, WithMaxPending(1), WithOverflowPolicy(OverflowBlock))
+	m.Publish("b", Message{})
+	<-started
+	m.Publish("b", Message{})
+	published = make(chan struct{})
+	go func() {
+		m.Publish("b", Message{})
+		close(published)
+	}()
+	sub.Unsubscribe()
+	<-published
+	close(block)
+}
+
+func TestDeliveryDisconnect(t *testing.T) {
+	m := NewStandAloneMessaging().(*standAloneImpl)
+	release := make(chan struct{})
+	defer close(release)
+	handler, started, _ := blockingHandler(release)
+	disconnected := make(chan struct{})
+	sub, _ := m.Subscribe("a", handler, WithMaxPending(1), WithOverflowPolicy(OverflowDisconnect),
+		WithOnDisconnect(func() { close(disconnected) }))
+
+	m.Publish("a", Message{})
+	<-started
+	m.Publish("a", Message{})
+	m.Publish("a", Message{})
+	<-disconnected
+	if sub.Dropped() != 1 {
+		t.Fatalf("Expected 1 dropped message, got %d", sub.Dropped())
+	}
+	if m.sublist.Count() != 0 {
+		t.Fatalf("Expected subscription to be removed, got %d", m.sublist.Count())
+	}
+	// Further messages are not queued.
+	m.Publish("a", Message{})
+	if sub.Dropped() != 1 {
+		t.Fatalf("Expected 1 dropped message, got %d", sub.Dropped())
+	}
+}
+
+func TestDeliveryReleasesGoroutine(t *testing.T) {
+	m := NewStandAloneMessaging()
+	before := runtime.NumGoroutine()
+	subs := make([]Subscriber, 100)
+	for i := range subs {
+		subs[i], _ = m.Subscribe("a", func(topic string, message Message) {})
+	}
+	for i := 0; i < 100; i++ {
+		m.Publish("a", Message{})
+	}
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+	waitFor(t, func() bool { return runtime.NumGoroutine() <= before })
+}
+
+func TestDeliveryDrainWaitsForPush(t *testing.T) {
+	var inFlight int64
+	box := newMailbox(1, OverflowDropNewest, &inFlight, nil)
+	delivered := make(chan string, 2)
+	go box.run(func(topic string, message Message) { delivered <- message.ID })
+
+	// A publisher is still inside push when the mailbox starts draining.
+	atomic.AddInt64(&inFlight, 1)
+	done := box.drain()
+	select {
+	case <-done:
+		t.Fatalf("Expected drain to wait for the push in progress")
+	case <-time.After(20 * time.Millisecond):
+	}
+	// The push is dropped: drain wakes up and finishes without a message.
+	box.release()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected drain to finish after the push was dropped")
+	}
+	if len(delivered) != 0 {
+		t.Fatalf("Unexpected delivery %v", <-delivered)
+	}
+}
@@ -1,25 +1,69 @@
 package internal
 
 import (
-	"github.com/gorilla/mux"
-	"github.com/gorilla/websocket"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
-)
+	"strings"
+	"sync"
 
-func Serve(addr string, comet Comet) {
-	r := mux.NewRouter()
+	"github.com/gorilla/websocket"
+)
 
-	h := NewHandler(comet)
-	r.HandleFunc("/peer/conn", h.HandlePeer)
-	r.HandleFunc("/service/conn", h.HandleService)
+// BaseResponse 错误响应，见 openapi/comet.yaml
+type BaseResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
 }
 
 type handler struct {
-	comet Comet
+	comet *Comet
+
+	mu       sync.Mutex
+	closing  bool                // 关闭中，不再接受连接
+	conns    sync.WaitGroup      // 处理中的连接
+	sessions map[*WSSession]bool // 业务系统连接
+}
+
+func NewHandler(comet *Comet) *handler {
+	return &handler{
+		comet:    comet,
+		sessions: make(map[*WSSession]bool),
+	}
+}
+
+// begin 登记连接，关闭中时返回 false
+func (p *handler) begin() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closing {
+		return false
+	}
+	p.conns.Add(1)
+	return true
+}
+
+func (p *handler) isClosing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.closing
 }
 
-func NewHandler(comet Comet) *handler {
-	return &handler{comet: comet}
+func (p *handler) addSession(sess *WSSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sessions[sess] = true
+}
+
+func (p *handler) removeSession(sess *WSSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.sessions, sess)
 }
 
 var upgrader = websocket.Upgrader{
@@ -28,62 +72,144 @@ var upgrader = websocket.Upgrader{
 }
 
 func (p *handler) HandlePeer(w http.ResponseWriter, r *http.Request) {
-	protocol := r.Header.Get("Comet-Protocol")
-	service := r.Header.Get("Comet-Service")
-	serviceToken := r.Header.Get("Comet-Service-Token")
-	clientID := r.Header.Get("Comet-Client-ID")
-	ip := r.RemoteAddr
+	if !p.begin() {
+		writeError(w, http.StatusServiceUnavailable, errServerClosed.Error())
+		return
+	}
+	defer p.conns.Done()
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	codec, subprotocol, err := negotiateProtocol(r)
 	if err != nil {
-		w.Write([]byte(err.Error()))
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	info, err := p.comet.AuthPeer(r.Context(), PeerInfo{
+		Protocol:     codec.Name(),
+		ClientID:     r.Header.Get("Comet-Client-ID"),
+		IP:           r.RemoteAddr,
+		Service:      r.Header.Get("Comet-Service"),
+		ServiceToken: r.Header.Get("Comet-Service-Token"),
+	})
+	if err != nil {
+		writeError(w, statusCode(err), err.Error())
 		return
 	}
-	sess := NewWSSession(r.Context(), conn, nil)
 
-	info := PeerInfo{
-		Protocol:     protocol,
-		ClientID:     clientID,
-		IP:           ip,
-		Service:      service,
-		ServiceToken: serviceToken,
+	var header http.Header
+	if subprotocol != "" {
+		header = http.Header{"Sec-Websocket-Protocol": {subprotocol}}
 	}
-	peer, err := p.comet.NewPeer(sess, info)
+	// 升级失败时 upgrader 已经返回错误响应
+	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
-		w.Write([]byte(err.Error()))
 		return
 	}
+	sess := NewWSSession(r.Context(), conn, nil)
+
+	peer, err := p.comet.newPeer(sess, info)
+	if err != nil {
+		closeWithError(sess, err)
+		return
+	}
+	// AddPeer 失败时已关闭连接
 	if err := p.comet.AddPeer(peer); err != nil {
-		w.Write([]byte(err.Error()))
 		return
 	}
 	defer p.comet.RemovePeer(peer)
+	// 关闭中时 Server.Shutdown 可能未看到该客户端
+	if p.isClosing() {
+		peer.Drain(r.Context(), websocket.CloseGoingAway, "server shutdown")
+	}
 
-	sess.Wait()
+	<-peer.Done()
 }
 
 func (p *handler) HandleService(w http.ResponseWriter, r *http.Request) {
-	serviceName := r.Header.Get("Comet-Service")
-
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		w.Write([]byte(err.Error()))
+	if !p.begin() {
+		writeError(w, http.StatusServiceUnavailable, errServerClosed.Error())
 		return
 	}
+	defer p.conns.Done()
 
-	service, ok := p.comet.GetService(serviceName)
+	service, ok := p.comet.GetService(r.Header.Get("Comet-Service"))
 	if !ok {
-		w.Write([]byte(err.Error()))
+		writeError(w, http.StatusNotFound, errServiceNotAvailable.Error())
+		return
+	}
+	// 升级前认证并检查连接数，AddWorker 时再次检查
+	if err := service.AuthWorker(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")); err != nil {
+		writeError(w, statusCode(err), err.Error())
 		return
 	}
 
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
 	sess := NewWSSession(r.Context(), conn, nil)
-	serviceSess := NewServiceWorker(sess)
-	if err := service.AddWorker(serviceSess); err != nil {
-		w.Write([]byte(err.Error()))
+	p.addSession(sess)
+	defer p.removeSession(sess)
+
+	worker, err := p.comet.NewServiceWorker(sess)
+	if err != nil {
+		closeWithError(sess, err)
+		return
+	}
+	// AddWorker 失败时已关闭连接
+	if err := service.AddWorker(worker); err != nil {
 		return
 	}
-	defer service.RemoveWorker(serviceSess)
+	defer service.RemoveWorker(worker)
 
-	sess.Wait()
+	<-worker.Done()
+}
+
+// statusCode 错误对应的 HTTP 状态码
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, errUnknownProtocol), errors.Is(err, errServiceInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, errServiceExists):
+		return http.StatusConflict
+	case errors.Is(err, errPeerUnauthorized), errors.Is(err, errWorkerUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, errServiceNotAvailable):
+		return http.StatusNotFound
+	case errors.Is(err, ErrAuthUnavailable), errors.Is(err, errServerClosed), errors.Is(err, errServiceFull):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError 以 BaseResponse 返回错误
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(BaseResponse{Code: code, Message: message})
+}
+
+// maxCloseReason WebSocket 控制消息最多 125 字节，其中关闭码占 2 字节
+const maxCloseReason = 123
+
+// closeWithError 升级后出错时以关闭码断开连接
+func closeWithError(c closeWithCoder, err error) {
+	code := websocket.CloseInternalServerErr
+	if errors.Is(err, errServiceNotAvailable) || errors.Is(err, errServiceFull) {
+		code = websocket.CloseTryAgainLater
+	}
+	reason := err.Error()
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+	}
+	c.CloseWithCode(code, reason)
+}
+
+// closeRejected 关闭未能登记的客户端或业务系统连接，支持关闭码时以错误对应的关闭码关闭
+func closeRejected(c io.Closer, err error) {
+	if cc, ok := c.(closeWithCoder); ok {
+		closeWithError(cc, err)
+		return
+	}
+	c.Close()
 }
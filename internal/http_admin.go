@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// adminHandler 业务系统管理接口，修改保存在 Comet 的 ServiceStore 中
+type adminHandler struct {
+	comet *Comet
+	token string
+}
+
+// auth 校验 Authorization: Bearer <token>
+func (p *adminHandler) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		want := []byte("Bearer " + p.token)
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (p *adminHandler) ListServices(w http.ResponseWriter, r *http.Request) {
+	configs, err := p.comet.ListServiceConfig(r.Context())
+	if err != nil {
+		writeError(w, statusCode(err), err.Error())
+		return
+	}
+	for i := range configs {
+		configs[i] = configs[i].redacted()
+	}
+	writeJSON(w, http.StatusOK, configs)
+}
+
+func (p *adminHandler) CreateService(w http.ResponseWriter, r *http.Request) {
+	var cfg ServiceConfig
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, err := p.comet.CreateService(r.Context(), cfg); err != nil {
+		writeError(w, statusCode(err), err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, cfg.redacted())
+}
+
+func (p *adminHandler) DeleteService(w http.ResponseWriter, r *http.Request) {
+	if err := p.comet.DeleteService(r.Context(), mux.Vars(r)["name"]); err != nil {
+		writeError(w, statusCode(err), err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
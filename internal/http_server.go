@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	errServerClosed = errors.New("server closed")
+)
+
+type ServerOptions struct {
+	TLSConfig         *tls.Config   // 不为空时使用 HTTPS
+	CertFile          string        // 证书文件，TLSConfig 中没有证书时使用
+	KeyFile           string        // 私钥文件
+	ReadHeaderTimeout time.Duration // 默认 10s
+	AdminToken        string        // 不为空时开放 /services 管理接口，请求需携带 Authorization: Bearer <AdminToken>
+}
+
+// Server Comet 的 HTTP 服务
+type Server struct {
+	handler  *handler
+	server   *http.Server
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	listener net.Listener
+}
+
+// Serve 创建监听 addr 的服务，调用 Start 后开始接受连接
+func Serve(addr string, comet *Comet) *Server {
+	return ServeWithOptions(addr, comet, ServerOptions{})
+}
+
+func ServeWithOptions(addr string, comet *Comet, opts ServerOptions) *Server {
+	if opts.ReadHeaderTimeout <= 0 {
+		opts.ReadHeaderTimeout = 10 * time.Second
+	}
+
+	r := mux.NewRouter()
+	h := NewHandler(comet)
+	r.HandleFunc("/peer/conn", h.HandlePeer)
+	r.HandleFunc("/service/conn", h.HandleService)
+	if opts.AdminToken != "" {
+		admin := &adminHandler{comet: comet, token: opts.AdminToken}
+		r.HandleFunc("/services", admin.auth(admin.ListServices)).Methods(http.MethodGet)
+		r.HandleFunc("/services", admin.auth(admin.CreateService)).Methods(http.MethodPost)
+		r.HandleFunc("/services/{name}", admin.auth(admin.DeleteService)).Methods(http.MethodDelete)
+	}
+
+	return &Server{
+		handler: h,
+		server: &http.Server{
+			Addr:              addr,
+			Handler:           r,
+			TLSConfig:         opts.TLSConfig,
+			ReadHeaderTimeout: opts.ReadHeaderTimeout,
+		},
+		certFile: opts.CertFile,
+		keyFile:  opts.KeyFile,
+	}
+}
+
+// Start 开始监听并在后台处理连接，监听失败时返回错误
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener != nil {
+		return errors.New("server already started")
+	}
+	ln, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+	s.listener = ln
+
+	tlsEnabled := s.server.TLSConfig != nil || s.certFile != "" || s.keyFile != ""
+	go func() {
+		if tlsEnabled {
+			s.server.ServeTLS(ln, s.certFile, s.keyFile)
+		} else {
+			s.server.Serve(ln)
+		}
+	}()
+	return nil
+}
+
+// Addr 监听地址，Start 之前为 nil
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Shutdown 停止接受连接，等待客户端待发送消息发送完毕后发送关闭消息，并等待 Comet.RemovePeer 完成；
+// ctx 结束时关闭所有连接并返回 ctx.Err()
+func (s *Server) Shutdown(ctx context.Context) error {
+	h := s.handler
+	h.mu.Lock()
+	h.closing = true
+	h.mu.Unlock()
+
+	// http.Server 不跟踪已升级的连接，需要单独关闭
+	err := s.server.Shutdown(ctx)
+
+	var wg sync.WaitGroup
+	for _, peer := range h.comet.ListPeer(ListPeerOption{}) {
+		wg.Add(1)
+		go func(peer Peer) {
+			defer wg.Done()
+			peer.Drain(ctx, websocket.CloseGoingAway, "server shutdown")
+		}(peer)
+	}
+	h.mu.Lock()
+	for sess := range h.sessions {
+		wg.Add(1)
+		go func(sess *WSSession) {
+			defer wg.Done()
+			sess.CloseWithCode(websocket.CloseGoingAway, "server shutdown")
+		}(sess)
+	}
+	h.mu.Unlock()
+	wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		h.conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func startTestServer(t *testing.T, opts ServerOptions) (*Server, *Comet, *standAloneImpl) {
+	t.Helper()
+	c, m := newTestComet(t)
+	s := ServeWithOptions("127.0.0.1:0", c, opts)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return s, c, m
+}
+
+func dialTestPeer(t *testing.T, dialer *websocket.Dialer, url string) *websocket.Conn {
+	t.Helper()
+	header := http.Header{"Comet-Service": {"chat"}, "Comet-Service-Token": {"1000"}}
+	conn, _, err := dialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return conn
+}
+
+func TestServerShutdown(t *testing.T) {
+	s, c, m := startTestServer(t, ServerOptions{})
+	url := "ws://" + s.Addr().String() + "/peer/conn"
+	conn := dialTestPeer(t, websocket.DefaultDialer, url)
+	defer conn.Close()
+
+	waitFor(t, func() bool { return c.CountPeer() == 1 })
+	peer := c.ListPeer(ListPeerOption{})[0]
+	_, subTopic := (&testService{info: ServiceInfo{Name: "chat"}}).GetPeerTopics(peer)
+	for i := 0; i < 10; i++ {
+		m.Publish(subTopic, Message{ID: "m"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.CountPeer() != 0 || m.sublist.Count() != 0 {
+		t.Fatalf("Expected peers to be removed, got %d peers and %d subscriptions", c.CountPeer(), m.sublist.Count())
+	}
+
+	// Queued messages are delivered before the close frame.
+	for i := 0; i < 10; i++ {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatalf("Message %d: unexpected error: %v", i, err)
+		}
+	}
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+		t.Fatalf("Expected close code %d, got %v", websocket.CloseGoingAway, err)
+	}
+
+	if _, _, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+		t.Fatalf("Expected new connections to be refused")
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ts.StartTLS()
+	certs := ts.TLS.Certificates
+	ts.Close()
+
+	s, c, _ := startTestServer(t, ServerOptions{TLSConfig: &tls.Config{Certificates: certs}})
+	dialer := &websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	conn := dialTestPeer(t, dialer, "wss://"+s.Addr().String()+"/peer/conn")
+	defer conn.Close()
+	waitFor(t, func() bool { return c.CountPeer() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
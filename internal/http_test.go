@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHandlePeerErrors(t *testing.T) {
+	c, _ := newTestComet(t)
+	c.pool.AddService(&testService{info: ServiceInfo{Name: "denied"}, authErr: errors.New("bad token")})
+	c.pool.AddService(&testService{info: ServiceInfo{Name: "down"}, authErr: ErrAuthUnavailable})
+	server := httptest.NewServer(http.HandlerFunc(NewHandler(c).HandlePeer))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	tests := []struct {
+		header http.Header
+		code   int
+	}{
+		{http.Header{"Comet-Service": {"chat"}, "Comet-Protocol": {"xml"}}, http.StatusBadRequest},
+		{http.Header{"Comet-Service": {"news"}}, http.StatusNotFound},
+		{http.Header{"Comet-Service": {"denied"}}, http.StatusUnauthorized},
+		{http.Header{"Comet-Service": {"down"}}, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		_, resp, err := websocket.DefaultDialer.Dial(url, test.header)
+		if err == nil || resp == nil {
+			t.Fatalf("%v: expected the upgrade to be rejected, got %v", test.header, err)
+		}
+		var body BaseResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.header, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.code || body.Code != test.code || body.Message == "" {
+			t.Fatalf("%v: expected %d, got %d %+v", test.header, test.code, resp.StatusCode, body)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("%v: unexpected content type %q", test.header, ct)
+		}
+	}
+	if c.CountPeer() != 0 {
+		t.Fatalf("Expected no peers, got %d", c.CountPeer())
+	}
+}
+
+func TestHandleClosing(t *testing.T) {
+	c, _ := newTestComet(t)
+	h := NewHandler(c)
+	h.closing = true
+
+	for _, handle := range []http.HandlerFunc{h.HandlePeer, h.HandleService} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Comet-Service", "chat")
+		handle(w, r)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("Expected %d, got %d", http.StatusServiceUnavailable, w.Code)
+		}
+	}
+}
+
+func TestHandleServiceNotFound(t *testing.T) {
+	c, _ := newTestComet(t)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Comet-Service", "news")
+	NewHandler(c).HandleService(w, r)
+
+	var body BaseResponse
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusNotFound || body.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d %s", http.StatusNotFound, w.Code, w.Body)
+	}
+}
+
+func TestHandleServiceAuth(t *testing.T) {
+	c, _ := newTestComet(t)
+	service, err := c.NewService(ServiceConfig{
+		Name:       "news",
+		Auth:       AuthConfig{Mode: AuthModeHMAC, Secret: "secret", WorkerToken: "worker"},
+		MaxWorkers: 1,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	c.RegisterService(service)
+	server := httptest.NewServer(http.HandlerFunc(NewHandler(c).HandleService))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	dial := func(token string) (*websocket.Conn, int) {
+		header := http.Header{"Comet-Service": {"news"}}
+		if token != "" {
+			header.Set("Authorization", "Bearer "+token)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if err != nil {
+			if resp == nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			resp.Body.Close()
+			return nil, resp.StatusCode
+		}
+		return conn, http.StatusSwitchingProtocols
+	}
+
+	if _, code := dial(""); code != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d", http.StatusUnauthorized, code)
+	}
+	if _, code := dial("admin"); code != http.StatusUnauthorized {
+		t.Fatalf("Expected %d, got %d", http.StatusUnauthorized, code)
+	}
+	conn, code := dial("worker")
+	if code != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected the worker to connect, got %d", code)
+	}
+	defer conn.Close()
+	waitFor(t, func() bool { return service.(*serviceImpl).servicePool.CountSession() == 1 })
+	if _, code := dial("worker"); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected %d, got %d", http.StatusServiceUnavailable, code)
+	}
+}
+
+func TestAdminServices(t *testing.T) {
+	s := ServeWithOptions("127.0.0.1:0", NewComet(NewStandAloneMessaging()), ServerOptions{AdminToken: "admin"})
+	server := httptest.NewServer(s.server.Handler)
+	defer server.Close()
+
+	do := func(method, path, token, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	news := `{"name":"news","auth":{"mode":"hmac","secret":"secret"}}`
+	tests := []struct {
+		method, path, token, body string
+		code                      int
+	}{
+		{http.MethodGet, "/services", "", "", http.StatusUnauthorized},
+		{http.MethodGet, "/services", "wrong", "", http.StatusUnauthorized},
+		{http.MethodPost, "/services", "admin", news, http.StatusCreated},
+		{http.MethodPost, "/services", "admin", news, http.StatusConflict},
+		{http.MethodPost, "/services", "admin", `{"name":"a.b","auth":{"mode":"hmac","secret":"s"}}`, http.StatusBadRequest},
+		{http.MethodPost, "/services", "admin", `not json`, http.StatusBadRequest},
+		{http.MethodDelete, "/services/news", "admin", "", http.StatusNoContent},
+		{http.MethodDelete, "/services/news", "admin", "", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		resp := do(test.method, test.path, test.token, test.body)
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Fatalf("%s %s %s: expected %d, got %d", test.method, test.path, test.body, test.code, resp.StatusCode)
+		}
+	}
+
+	do(http.MethodPost, "/services", "admin", news).Body.Close()
+	resp := do(http.MethodGet, "/services", "admin", "")
+	defer resp.Body.Close()
+	var configs []ServiceConfig
+	json.NewDecoder(resp.Body).Decode(&configs)
+	if len(configs) != 1 || configs[0].Name != "news" || configs[0].Auth.Secret == "secret" {
+		t.Fatalf("Unexpected services %+v", configs)
+	}
+}
@@ -2,12 +2,18 @@ package internal
 
 import (
 	"context"
+	"errors"
+	"io"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+var (
+	errWSSessionClosed = errors.New("websocket session closed")
+)
+
 type WSSessionOption struct {
 	ReadTimeout      time.Duration
 	WriteTimeout     time.Duration
@@ -16,14 +22,19 @@ type WSSessionOption struct {
 
 type wsReadCmd struct {
 	buf    []byte
+	frame  bool // 读取整条消息到 data
+	data   []byte
 	resN   int
 	resErr error
+	done   chan struct{}
 }
 
 type wsWriteCmd struct {
 	data   []byte
+	binary bool
 	resN   int
 	resErr error
+	done   chan struct{}
 }
 
 type WSSession struct {
@@ -35,6 +46,7 @@ type WSSession struct {
 
 	once   sync.Once
 	waiter sync.WaitGroup
+	closed chan struct{}
 	pings  int
 	pongs  int
 
@@ -56,6 +68,7 @@ func NewWSSession(ctx context.Context, conn *websocket.Conn, option *WSSessionOp
 		readTimeout:      option.ReadTimeout,
 		writeTimeout:     option.WriteTimeout,
 		pingPongInterval: option.PingPongInterval,
+		closed:           make(chan struct{}),
 		readQueue:        make(chan *wsReadCmd),
 		writeQueue:       make(chan *wsWriteCmd),
 	}
@@ -67,42 +80,112 @@ func NewWSSession(ctx context.Context, conn *websocket.Conn, option *WSSessionOp
 }
 
 func (s *WSSession) Read(p []byte) (int, error) {
-	c := &wsReadCmd{buf: p}
-	s.readQueue <- c
+	c := &wsReadCmd{buf: p, done: make(chan struct{})}
+	if err := s.doRead(c); err != nil {
+		return 0, err
+	}
 	return c.resN, c.resErr
 }
 
 func (s *WSSession) Write(data []byte) (int, error) {
-	c := &wsWriteCmd{data: data}
-	s.writeQueue <- c
+	c := &wsWriteCmd{data: data, binary: true, done: make(chan struct{})}
+	if err := s.doWrite(c); err != nil {
+		return 0, err
+	}
 	return c.resN, c.resErr
 }
 
+// ReadFrame 读取一条完整的消息
+func (s *WSSession) ReadFrame() ([]byte, error) {
+	c := &wsReadCmd{frame: true, done: make(chan struct{})}
+	if err := s.doRead(c); err != nil {
+		return nil, err
+	}
+	return c.data, c.resErr
+}
+
+// WriteFrame 以一条文本或二进制消息发送 data
+func (s *WSSession) WriteFrame(data []byte, binary bool) error {
+	c := &wsWriteCmd{data: data, binary: binary, done: make(chan struct{})}
+	if err := s.doWrite(c); err != nil {
+		return err
+	}
+	return c.resErr
+}
+
+// Close 关闭连接，正在等待的读写返回 errWSSessionClosed
+func (s *WSSession) Close() error {
+	s.shutdown()
+	return nil
+}
+
+// CloseWithCode 发送关闭消息后关闭连接
+func (s *WSSession) CloseWithCode(code int, text string) error {
+	deadline := time.Now().Add(s.writeTimeout)
+	err := s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), deadline)
+	s.shutdown()
+	return err
+}
+
 func (s *WSSession) Wait() {
 	s.waiter.Wait()
 }
 
-// 防止并发读
-func (s *WSSession) readPump() {
-	defer s.once.Do(func() {
+func (s *WSSession) doRead(c *wsReadCmd) error {
+	select {
+	case s.readQueue <- c:
+	case <-s.closed:
+		return errWSSessionClosed
+	}
+	<-c.done
+	return nil
+}
+
+func (s *WSSession) doWrite(c *wsWriteCmd) error {
+	select {
+	case s.writeQueue <- c:
+	case <-s.closed:
+		return errWSSessionClosed
+	}
+	<-c.done
+	return nil
+}
+
+// shutdown 关闭连接并停止读写，读写任一出错时调用
+func (s *WSSession) shutdown() {
+	s.once.Do(func() {
+		close(s.closed)
+		s.conn.Close()
 		s.waiter.Done()
 	})
+}
+
+// 防止并发读
+func (s *WSSession) readPump() {
+	defer s.shutdown()
 
-	if err := s.conn.SetReadDeadline(time.Now().Add(s.pingPongInterval)); err != nil {
+	if err := s.conn.SetReadDeadline(time.Now().Add(s.pingPongInterval + s.readTimeout)); err != nil {
 		return
 	}
 	s.conn.SetPongHandler(func(string) error {
-		// TODO
-		return nil
+		s.pongs++
+		return s.conn.SetReadDeadline(time.Now().Add(s.pingPongInterval + s.readTimeout))
 	})
 
 	for {
 		select {
 		case cmd := <-s.readQueue:
-			cmd.resN, cmd.resErr = s.read(cmd.buf)
+			if cmd.frame {
+				cmd.data, cmd.resErr = s.readFrame()
+			} else {
+				cmd.resN, cmd.resErr = s.read(cmd.buf)
+			}
+			close(cmd.done)
 			if cmd.resErr != nil {
 				return
 			}
+		case <-s.closed:
+			return
 		case <-s.ctx.Done():
 			return
 		}
@@ -111,15 +194,16 @@ func (s *WSSession) readPump() {
 
 // 防止并发发送数据或Ping
 func (s *WSSession) writePump() {
-	defer s.once.Do(func() {
-		s.waiter.Done()
-	})
+	defer s.shutdown()
 
 	ticker := time.NewTicker(s.pingPongInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case cmd := <-s.writeQueue:
-			if cmd.resN, cmd.resErr = s.write(cmd.data); cmd.resErr != nil {
+			cmd.resN, cmd.resErr = s.write(cmd.data, cmd.binary)
+			close(cmd.done)
+			if cmd.resErr != nil {
 				return
 			}
 		case <-ticker.C:
@@ -132,6 +216,8 @@ func (s *WSSession) writePump() {
 			}
 
 			s.pings++
+		case <-s.closed:
+			return
 		case <-s.ctx.Done():
 			return
 		}
@@ -151,14 +237,39 @@ func (s *WSSession) read(p []byte) (int, error) {
 	return reader.Read(p)
 }
 
-func (s *WSSession) write(data []byte) (int, error) {
+func (s *WSSession) readFrame() ([]byte, error) {
+	_, reader, err := s.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(s.readTimeout)
+	if err := s.conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	// 等待下一条消息的时间不受 readTimeout 限制，由 Ping/Pong 保活
+	if err := s.conn.SetReadDeadline(time.Now().Add(s.pingPongInterval + s.readTimeout)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *WSSession) write(data []byte, binary bool) (int, error) {
 	deadline := time.Now().Add(s.writeTimeout)
 	if err := s.conn.SetWriteDeadline(deadline); err != nil {
 		_ = s.conn.WriteMessage(websocket.CloseMessage, []byte{})
 		return 0, err
 	}
 
-	writer, err := s.conn.NextWriter(websocket.BinaryMessage)
+	messageType := websocket.TextMessage
+	if binary {
+		messageType = websocket.BinaryMessage
+	}
+	writer, err := s.conn.NextWriter(messageType)
 	if err != nil {
 		return 0, err
 	}
@@ -1,18 +1,73 @@
 package internal
 
 import (
+	"context"
 	cryptoRand "crypto/rand"
 	"encoding/hex"
 	"io"
-	"math/rand"
+	"sync"
+	"time"
 )
 
 type Message struct {
-	ID      string
-	Service string
-	Topic   string
-	Payload []byte
-	Time    int
+	ID       string
+	Service  string
+	Identity string // 业务系统用户唯一标识
+	Topic    string
+	Reply    string // 回复主题，由 Request 设置，响应者向该主题发布响应
+	Header   Header // 消息头，发布后由所有订阅者共享，订阅者不能修改
+	Payload  []byte
+	Time     time.Time // 消息时间，发布时为空则设为当前时间，传输时精确到毫秒
+}
+
+// 常用消息头
+const (
+	HeaderContentType   = "Content-Type"
+	HeaderCorrelationID = "Correlation-Id"
+	HeaderTraceParent   = "Traceparent" // W3C Trace Context
+	HeaderTraceState    = "Tracestate"
+	HeaderPeerID        = "Comet-Peer-Id"  // 发送消息的客户端连接ID，由 Comet 设置
+	HeaderIdentity      = "Comet-Identity" // 发送消息的业务系统用户唯一标识，由 Comet 设置
+)
+
+// Header 消息头
+type Header map[string]string
+
+// Get 获取消息头，不存在时返回空字符串
+func (h Header) Get(key string) string {
+	return h[key]
+}
+
+// Set 设置消息头，h 不能为 nil
+func (h Header) Set(key, value string) {
+	h[key] = value
+}
+
+// Del 删除消息头
+func (h Header) Del(key string) {
+	delete(h, key)
+}
+
+// Clone 复制消息头，h 为 nil 时返回 nil
+func (h Header) Clone() Header {
+	if h == nil {
+		return nil
+	}
+	nh := make(Header, len(h))
+	for k, v := range h {
+		nh[k] = v
+	}
+	return nh
+}
+
+// WithHeader 返回设置了消息头的消息副本，原消息的消息头不受影响
+func (m Message) WithHeader(key, value string) Message {
+	m.Header = m.Header.Clone()
+	if m.Header == nil {
+		m.Header = make(Header)
+	}
+	m.Header.Set(key, value)
+	return m
 }
 
 const (
@@ -32,24 +87,70 @@ type MessageJoin struct {
 type SubscribeHandler func(topic string, message Message)
 
 type Subscriber interface {
-	// Unsubscribe 取消订阅
+	// Unsubscribe 取消订阅，未投递的消息被丢弃
 	Unsubscribe()
+	// Pending 投递队列中等待处理的消息数
+	Pending() int
+	// Dropped 因投递队列已满被丢弃的消息数
+	Dropped() uint64
 }
 
 type Messaging interface {
-	// Subscribe 订阅消息，同一主题，各个订阅者都会收到消息
-	Subscribe(topicPattern string, handler SubscribeHandler) Subscriber
-	// QueueSubscribe 订阅消息，同一主题，只有一个订阅者会收到消息
-	QueueSubscribe(topicPattern string, queue string, handler SubscribeHandler) Subscriber
-	// Publish 发布消息
+	// Subscribe 订阅消息，同一主题，各个订阅者都会收到消息；主题不合法时返回 ErrInvalidSubject
+	Subscribe(topicPattern string, handler SubscribeHandler, opts ...SubscribeOption) (Subscriber, error)
+	// QueueSubscribe 订阅消息，同一主题，只有一个订阅者会收到消息，由队列组的负载均衡策略选出
+	QueueSubscribe(topicPattern string, queue string, handler SubscribeHandler, opts ...SubscribeOption) (Subscriber, error)
+	// Publish 发布消息，主题不能包含通配符；同一订阅者按发布顺序收到消息
 	Publish(topic string, msg Message) error
+	// Request 发布请求并等待第一个响应，超时或取消时返回 ctx.Err()，没有订阅者时返回 ErrNoResponders
+	Request(ctx context.Context, topic string, msg Message) (Message, error)
+	// RequestMany 发布请求并收集响应，直到收到 max 个响应（max <= 0 表示不限）或 ctx 结束；
+	// 一个响应也没有收到时返回 ctx.Err()
+	RequestMany(ctx context.Context, topic string, msg Message, max int) ([]Message, error)
 }
 
 type subscription struct {
 	topicPattern string
 	queue        string
 	sid          string
-	handler      SubscribeHandler
+	weight       int
+	inFlight     int64 // 排队及处理中的消息数
+	box          *mailbox
+}
+
+// SubscribeOption 订阅选项
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	strategy     QueueStrategy
+	strategySet  bool
+	weight       int
+	key          QueueKeyFunc
+	maxPending   int
+	overflow     OverflowPolicy
+	onDisconnect func()
+}
+
+func newSubscribeOptions(opts []SubscribeOption) subscribeOptions {
+	o := subscribeOptions{
+		weight:     1,
+		key:        DefaultQueueKey,
+		maxPending: defaultMaxPending,
+		overflow:   OverflowDropNewest,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.weight < 1 {
+		o.weight = 1
+	}
+	if o.key == nil {
+		o.key = DefaultQueueKey
+	}
+	if o.maxPending < 1 {
+		o.maxPending = 1
+	}
+	return o
 }
 
 func genId() string {
@@ -59,61 +160,150 @@ func genId() string {
 }
 
 type standAloneSubscriber struct {
-	sublist *Sublist
-	sub     *subscription
+	m    *standAloneImpl
+	sub  *subscription
+	once sync.Once
 }
 
 func (s *standAloneSubscriber) Unsubscribe() {
-	s.sublist.Remove(s.sub.topicPattern, s.sub)
+	s.remove()
+	s.sub.box.close()
+}
+
+// drain 停止接收新消息，已入队的消息投递完毕后关闭返回的通道，见 subscriberDrainer
+func (s *standAloneSubscriber) drain() <-chan struct{} {
+	s.remove()
+	return s.sub.box.drain()
+}
+
+func (s *standAloneSubscriber) remove() {
+	s.once.Do(func() {
+		s.m.sublist.RemoveQueue(s.sub.topicPattern, s.sub.queue, s.sub)
+		if s.sub.queue != "" {
+			s.m.leaveQueue(s.sub.topicPattern, s.sub.queue)
+		}
+	})
+}
+
+func (s *standAloneSubscriber) Pending() int {
+	return s.sub.box.pending()
+}
+
+func (s *standAloneSubscriber) Dropped() uint64 {
+	return s.sub.box.droppedCount()
 }
 
 type standAloneImpl struct {
-	sublist *Sublist
+	sublist *Sublist[*subscription]
+
+	queuesMu sync.RWMutex
+	queues   map[queueKey]*queueGroup
 }
 
 func NewStandAloneMessaging() Messaging {
-	return &standAloneImpl{sublist: NewSublist()}
+	return &standAloneImpl{
+		sublist: NewSublist[*subscription](),
+		queues:  make(map[queueKey]*queueGroup),
+	}
 }
 
-func (m *standAloneImpl) Subscribe(topicPattern string, handler SubscribeHandler) Subscriber {
-	return m.QueueSubscribe(topicPattern, "", handler)
+func (m *standAloneImpl) Subscribe(topicPattern string, handler SubscribeHandler, opts ...SubscribeOption) (Subscriber, error) {
+	return m.QueueSubscribe(topicPattern, "", handler, opts...)
 }
 
-func (m *standAloneImpl) QueueSubscribe(topicPattern string, queue string, handler SubscribeHandler) Subscriber {
+func (m *standAloneImpl) QueueSubscribe(topicPattern string, queue string, handler SubscribeHandler, opts ...SubscribeOption) (Subscriber, error) {
+	o := newSubscribeOptions(opts)
 	s := &subscription{
 		topicPattern: topicPattern,
 		sid:          genId(),
 		queue:        queue,
-		handler:      handler,
+		weight:       o.weight,
 	}
-	m.sublist.Insert(topicPattern, s)
+	subscriber := &standAloneSubscriber{
+		m:   m,
+		sub: s,
+	}
+	s.box = newMailbox(o.maxPending, o.overflow, &s.inFlight, func() {
+		subscriber.Unsubscribe()
+		if o.onDisconnect != nil {
+			go o.onDisconnect()
+		}
+	})
+	if queue != "" {
+		if err := m.joinQueue(topicPattern, queue, o); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.sublist.InsertQueue(topicPattern, queue, s); err != nil {
+		if queue != "" {
+			m.leaveQueue(topicPattern, queue)
+		}
+		return nil, err
+	}
+	go s.box.run(handler)
 
-	return &standAloneSubscriber{
-		sublist: m.sublist,
-		sub:     s,
+	return subscriber, nil
+}
+
+// joinQueue 登记队列组成员，第一个成员决定队列组的负载均衡策略；不同主题的同名队列组互不影响
+func (m *standAloneImpl) joinQueue(topicPattern, queue string, o subscribeOptions) error {
+	m.queuesMu.Lock()
+	defer m.queuesMu.Unlock()
+
+	key := queueKey{topicPattern: topicPattern, queue: queue}
+	g, ok := m.queues[key]
+	if !ok {
+		g = &queueGroup{strategy: o.strategy, balancer: newQueueBalancer(o)}
+		m.queues[key] = g
+	} else if o.strategySet && o.strategy != g.strategy {
+		return errQueueStrategyConflict
+	}
+	g.members++
+	return nil
+}
+
+func (m *standAloneImpl) leaveQueue(topicPattern, queue string) {
+	m.queuesMu.Lock()
+	defer m.queuesMu.Unlock()
+
+	key := queueKey{topicPattern: topicPattern, queue: queue}
+	g, ok := m.queues[key]
+	if !ok {
+		return
+	}
+	if g.members--; g.members == 0 {
+		delete(m.queues, key)
 	}
 }
 
+// balancer 队列组成员来自多个匹配主题时，使用第一个成员所在主题的策略
+func (m *standAloneImpl) balancer(g QueueGroup[*subscription]) queueBalancer {
+	m.queuesMu.RLock()
+	defer m.queuesMu.RUnlock()
+
+	if g, ok := m.queues[queueKey{topicPattern: g.Members[0].topicPattern, queue: g.Name}]; ok {
+		return g.balancer
+	}
+	return randomBalancer{}
+}
+
 func (m *standAloneImpl) Publish(topic string, msg Message) error {
-	sublist := m.sublist.Match(topic)
-
-	var subs []*subscription
-	queueSubs := make(map[string][]*subscription)
-	for _, item := range sublist {
-		s := item.(*subscription)
-		if s.queue == "" {
-			subs = append(subs, s)
-		} else {
-			queueSubs[s.queue] = append(queueSubs[s.queue], s)
-		}
+	r, err := m.sublist.MatchResult(topic)
+	if err != nil {
+		return err
+	}
+	// 订阅者共享消息头，复制后发布者可以继续修改自己的消息头
+	msg.Header = msg.Header.Clone()
+	if msg.Time.IsZero() {
+		msg.Time = time.Now()
 	}
 
-	for _, l := range subs {
-		go l.handler(topic, msg)
+	for _, l := range r.Subs {
+		l.box.push(topic, msg)
 	}
-	for _, l := range queueSubs {
-		i := rand.Intn(len(l))
-		go l[i].handler(topic, msg)
+	for _, g := range r.Queues {
+		l := m.balancer(g).pick(g.Members, &msg)
+		l.box.push(topic, msg)
 	}
 
 	return nil
@@ -1,7 +1,10 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -22,3 +25,87 @@ func TestMessaging(t *testing.T) {
 	m.Publish("a.b", Message{Payload: []byte("ab")})
 	time.Sleep(2 * time.Second)
 }
+
+func TestMessagingInvalidTopic(t *testing.T) {
+	m := NewStandAloneMessaging()
+	handler := func(topic string, message Message) {}
+	if _, err := m.Subscribe("a..b", handler); !errors.Is(err, ErrInvalidSubject) {
+		t.Fatalf("Subscribe expected ErrInvalidSubject, got %v", err)
+	}
+	if _, err := m.QueueSubscribe("a.>.b", "q", handler); !errors.Is(err, ErrInvalidSubject) {
+		t.Fatalf("QueueSubscribe expected ErrInvalidSubject, got %v", err)
+	}
+	if err := m.Publish("a.*", Message{}); !errors.Is(err, ErrInvalidSubject) {
+		t.Fatalf("Publish expected ErrInvalidSubject, got %v", err)
+	}
+	if err := m.Publish("a.", Message{}); !errors.Is(err, ErrInvalidSubject) {
+		t.Fatalf("Publish expected ErrInvalidSubject, got %v", err)
+	}
+}
+
+func TestMessagingQueueSubscribe(t *testing.T) {
+	m := NewStandAloneMessaging()
+
+	var wg sync.WaitGroup
+	var plain, queued int32
+	m.Subscribe("a.>", func(topic string, message Message) {
+		atomic.AddInt32(&plain, 1)
+		wg.Done()
+	})
+	for i := 0; i < 3; i++ {
+		m.QueueSubscribe("a.*", "workers", func(topic string, message Message) {
+			atomic.AddInt32(&queued, 1)
+			wg.Done()
+		})
+	}
+
+	wg.Add(2 * 100)
+	for i := 0; i < 100; i++ {
+		if err := m.Publish("a.b", Message{}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	wg.Wait()
+	if plain != 100 || queued != 100 {
+		t.Fatalf("Expected 100 plain and 100 queue deliveries, got %d and %d", plain, queued)
+	}
+}
+
+func TestMessagingHeaders(t *testing.T) {
+	m := NewStandAloneMessaging()
+
+	received := make(chan Message, 2)
+	for i := 0; i < 2; i++ {
+		m.Subscribe("a", func(topic string, message Message) {
+			received <- message
+		})
+	}
+
+	header := Header{HeaderContentType: "application/json"}
+	msg := Message{Header: header}.WithHeader(HeaderCorrelationID, "1")
+	if _, ok := header[HeaderCorrelationID]; ok {
+		t.Fatalf("WithHeader modified the original header")
+	}
+	before := time.Now()
+	if err := m.Publish("a", msg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	msg.Header.Set(HeaderCorrelationID, "2")
+
+	for i := 0; i < 2; i++ {
+		r := <-received
+		if r.Header.Get(HeaderContentType) != "application/json" || r.Header.Get(HeaderCorrelationID) != "1" {
+			t.Fatalf("Unexpected header %v", r.Header)
+		}
+		if r.Time.Before(before) {
+			t.Fatalf("Expected publish time to be set, got %v", r.Time)
+		}
+	}
+
+	at := time.Unix(1648006263, 0)
+	m.Publish("a", Message{Time: at})
+	if r := <-received; !r.Time.Equal(at) {
+		t.Fatalf("Expected time %v, got %v", at, r.Time)
+	}
+	<-received
+}
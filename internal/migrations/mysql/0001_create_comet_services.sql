@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS comet_services (
+    name         VARCHAR(64)   NOT NULL,
+    namespace    VARCHAR(255)  NOT NULL DEFAULT '',
+    auth         TEXT          NOT NULL,
+    presence_url VARCHAR(1024) NOT NULL DEFAULT '',
+    max_peers    INT           NOT NULL DEFAULT 0,
+    max_workers  INT           NOT NULL DEFAULT 0,
+    created_at   DATETIME(3)   NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+    updated_at   DATETIME(3)   NOT NULL DEFAULT CURRENT_TIMESTAMP(3) ON UPDATE CURRENT_TIMESTAMP(3),
+    PRIMARY KEY (name)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4;
@@ -1,18 +1,32 @@
 package internal
 
 import (
+	"context"
 	"errors"
 	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	errPeerAlreadySetReceiveChannel = errors.New("peer already set receive channel")
 	errPeerClosed                   = errors.New("peer closed")
+	errPeerSendQueueFull            = errors.New("peer send queue full")
+	errPeerAlreadySubscribed        = errors.New("peer already subscribed")
+	errPeerNotSubscribed            = errors.New("peer not subscribed")
 )
 
+// defaultPeerSendQueue 客户端待发送队列的默认长度
+const defaultPeerSendQueue = 256
+
+// maxFrameSize 非按帧读写的连接，单次读取的最大长度
+const maxFrameSize = 64 * 1024
+
 type PeerInfo struct {
 	ID              string          `json:"id"`
-	Protocol        string          `json:"protocol"`        // 连接协议，目前只支持JSON
+	Protocol        string          `json:"protocol"`        // 连接协议，见 GetCodec
 	ClientID        string          `json:"client_id"`       // 客户端ID
 	IP              string          `json:"ip"`              // 客户端IP
 	Service         string          `json:"service"`         // 业务系统，TODO 多业务系统支持
@@ -22,24 +36,108 @@ type PeerInfo struct {
 
 type Peer interface {
 	Info() PeerInfo
+	// Receive 指定接收客户端消息的通道并开始读取连接，只能调用一次
 	Receive(out chan<- *Message) error
+	// Send 将消息放入发送队列，不会阻塞；队列超出限制时按 SlowConsumerPolicy 处理，
+	// 丢弃时返回 errPeerSendQueueFull，断开时返回 errPeerSlowConsumer，已关闭时返回 errPeerClosed
 	Send(msg *Message) error
-	Subscribe()
-	UnSubscribe()
+	// Subscribe 记录客户端订阅，关闭连接时取消；已订阅时返回 errPeerAlreadySubscribed，已关闭或正在 Drain 时返回 errPeerClosed
+	Subscribe(topicPattern string, subscriber Subscriber) error
+	// UnSubscribe 取消客户端订阅，未订阅时返回 errPeerNotSubscribed
+	UnSubscribe(topicPattern string) error
+	// Subscriptions 客户端订阅的主题
+	Subscriptions() []string
+	// Close 关闭连接并取消所有订阅，可重复调用
+	Close() error
+	// Drain 停止从订阅接收新消息，订阅中已发布的消息进入待发送队列后不再接受新消息，
+	// 待发送队列发送完毕后以 code 关闭连接；ctx 结束时直接关闭并返回 ctx.Err()
+	Drain(ctx context.Context, code int, text string) error
+	// Done 连接关闭（包括读写出错）时关闭
+	Done() <-chan struct{}
+}
+
+// FrameReadWriter 按帧读写的连接，每帧对应一条消息，如 WSSession
+type FrameReadWriter interface {
+	ReadFrame() ([]byte, error)
+	WriteFrame(data []byte, binary bool) error
+}
+
+// closeWithCoder 可以指定关闭码的连接，如 WSSession
+type closeWithCoder interface {
+	CloseWithCode(code int, text string) error
+}
+
+// ioFrameReadWriter 将 io.ReadWriter 的每次读写视为一帧
+type ioFrameReadWriter struct {
+	rw  io.ReadWriter
+	buf []byte
+}
+
+func (f *ioFrameReadWriter) ReadFrame() ([]byte, error) {
+	if f.buf == nil {
+		f.buf = make([]byte, maxFrameSize)
+	}
+	n, err := f.rw.Read(f.buf)
+	if n > 0 {
+		return append([]byte(nil), f.buf[:n]...), nil
+	}
+	if err == nil {
+		err = io.ErrNoProgress
+	}
+	return nil, err
+}
+
+func (f *ioFrameReadWriter) WriteFrame(data []byte, binary bool) error {
+	_, err := f.rw.Write(data)
+	return err
 }
 
 type peerImpl struct {
-	conn io.ReadWriter
-	info PeerInfo
-	in   chan *Message
-	out  chan<- *Message
+	conn  io.ReadWriter
+	frame FrameReadWriter
+	codec Codec
+	info  PeerInfo
+	opts  PeerOptions
+	queue *peerQueue // 待发送消息
+	out   chan<- *Message
+
+	subsMu sync.Mutex
+	subs   map[string]Subscriber // 关闭后为 nil
+
+	outOnce   sync.Once
+	closeOnce sync.Once
+	draining  int32 // peerDrainSubscriptions 或 peerDrainQueue
+	code      int   // 关闭码，done 关闭后可读
+	done      chan struct{}
 }
 
-func NewPeer(conn io.ReadWriter, info PeerInfo) Peer {
-	return &peerImpl{
-		conn: conn,
-		info: info,
+// Drain 的阶段
+const (
+	peerDrainSubscriptions = 1 // 不再接受新订阅，订阅中已入队的消息仍会发送
+	peerDrainQueue         = 2 // 不再接受新消息，等待发送队列清空
+)
+
+func NewPeer(conn io.ReadWriter, codec Codec, info PeerInfo) Peer {
+	return NewPeerWithOptions(conn, codec, info, PeerOptions{})
+}
+
+func NewPeerWithOptions(conn io.ReadWriter, codec Codec, info PeerInfo, opts PeerOptions) Peer {
+	frame, ok := conn.(FrameReadWriter)
+	if !ok {
+		frame = &ioFrameReadWriter{rw: conn}
 	}
+	p := &peerImpl{
+		conn:  conn,
+		frame: frame,
+		codec: codec,
+		info:  info,
+		opts:  opts,
+		queue: newPeerQueue(opts),
+		subs:  make(map[string]Subscriber),
+		done:  make(chan struct{}),
+	}
+	go p.writeLoop()
+	return p
 }
 
 func (p *peerImpl) Info() PeerInfo {
@@ -47,24 +145,231 @@ func (p *peerImpl) Info() PeerInfo {
 }
 
 func (p *peerImpl) Receive(out chan<- *Message) error {
-	if p.out != nil {
-		return errPeerAlreadySetReceiveChannel
+	err := errPeerAlreadySetReceiveChannel
+	p.outOnce.Do(func() {
+		p.out = out
+		err = nil
+		go p.readLoop()
+	})
+	return err
+}
+
+func (p *peerImpl) Send(msg *Message) error {
+	select {
+	case <-p.done:
+		return errPeerClosed
+	default:
+	}
+	if atomic.LoadInt32(&p.draining) == peerDrainQueue {
+		return errPeerClosed
+	}
+
+	data, err := p.codec.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	e, err := p.queue.push(peerFrame{topic: msg.Topic, data: data})
+	if errors.Is(err, errPeerSlowConsumer) {
+		p.closeWithCode(CloseCodeSlowConsumer, "slow consumer", false)
+	}
+	if e != nil && p.opts.OnSlowConsumer != nil {
+		e.PeerID = p.info.ID
+		e.ClientID = p.info.ClientID
+		e.Identity = p.info.ServiceIdentity.Identity
+		p.opts.OnSlowConsumer(p, *e)
+	}
+	return err
+}
+
+func (p *peerImpl) Subscribe(topicPattern string, subscriber Subscriber) error {
+	p.subsMu.Lock()
+	defer p.subsMu.Unlock()
+
+	if p.subs == nil || atomic.LoadInt32(&p.draining) != 0 {
+		return errPeerClosed
+	}
+	if _, ok := p.subs[topicPattern]; ok {
+		return errPeerAlreadySubscribed
 	}
-	p.out = out
+	p.subs[topicPattern] = subscriber
 	return nil
 }
 
-func (p *peerImpl) Send(msg *Message) error {
-	p.in <- msg
+func (p *peerImpl) UnSubscribe(topicPattern string) error {
+	p.subsMu.Lock()
+	subscriber, ok := p.subs[topicPattern]
+	delete(p.subs, topicPattern)
+	p.subsMu.Unlock()
+
+	if !ok {
+		return errPeerNotSubscribed
+	}
+	subscriber.Unsubscribe()
 	return nil
 }
 
-func (p *peerImpl) Subscribe() {
-	//TODO implement me
-	panic("implement me")
+func (p *peerImpl) Subscriptions() []string {
+	p.subsMu.Lock()
+	defer p.subsMu.Unlock()
+
+	topics := make([]string, 0, len(p.subs))
+	for topic := range p.subs {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+func (p *peerImpl) Close() error {
+	return p.closeWithCode(0, "", false)
+}
+
+// CloseWithCode 以 code 关闭连接并取消所有订阅，连接不支持关闭码时直接关闭，见 closeWithCoder
+func (p *peerImpl) CloseWithCode(code int, text string) error {
+	return p.closeWithCode(code, text, true)
+}
+
+func (p *peerImpl) Drain(ctx context.Context, code int, text string) error {
+	// 不再接受新订阅，并停止从订阅接收新消息，已进入订阅投递队列的消息仍会发送
+	atomic.StoreInt32(&p.draining, peerDrainSubscriptions)
+	p.subsMu.Lock()
+	var drained []<-chan struct{}
+	for topic, subscriber := range p.subs {
+		if d, ok := subscriber.(subscriberDrainer); ok {
+			drained = append(drained, d.drain())
+		} else {
+			subscriber.Unsubscribe()
+			delete(p.subs, topic)
+		}
+	}
+	p.subsMu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	wait := func(idle func() bool) error {
+		for !idle() {
+			select {
+			case <-ticker.C:
+			case <-p.done:
+				return errPeerClosed
+			case <-ctx.Done():
+				p.Close()
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+
+	err := wait(func() bool {
+		for _, done := range drained {
+			select {
+			case <-done:
+			default:
+				return false
+			}
+		}
+		return true
+	})
+	// 订阅中的消息已全部进入发送队列，此后不再接受新消息
+	if err == nil {
+		atomic.StoreInt32(&p.draining, peerDrainQueue)
+		err = wait(p.queue.idle)
+	}
+	if errors.Is(err, errPeerClosed) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return p.closeWithCode(code, text, true)
+}
+
+// subscriberDrainer 可以停止接收新消息并投递完已入队消息的订阅，如 standAloneSubscriber
+type subscriberDrainer interface {
+	drain() <-chan struct{}
 }
 
-func (p *peerImpl) UnSubscribe() {
-	//TODO implement me
-	panic("implement me")
+// closeWithCode 关闭连接，code 不为0且连接支持时发送关闭码；wait 为 false 时不等待关闭码发送完成
+func (p *peerImpl) closeWithCode(code int, text string, wait bool) error {
+	var err error
+	p.closeOnce.Do(func() {
+		p.code = code
+		close(p.done)
+
+		p.subsMu.Lock()
+		subs := p.subs
+		p.subs = nil
+		p.subsMu.Unlock()
+		for _, subscriber := range subs {
+			subscriber.Unsubscribe()
+		}
+
+		if c, ok := p.conn.(closeWithCoder); ok && code != 0 {
+			if wait {
+				err = c.CloseWithCode(code, text)
+			} else {
+				// 发送关闭消息可能要等待正在进行的写入，不阻塞调用者
+				go c.CloseWithCode(code, text)
+			}
+		} else if c, ok := p.conn.(io.Closer); ok {
+			err = c.Close()
+		}
+	})
+	return err
+}
+
+func (p *peerImpl) Done() <-chan struct{} {
+	return p.done
+}
+
+// closeCode 关闭连接时使用的关闭码，未关闭或直接关闭时为 0
+func (p *peerImpl) closeCode() int {
+	select {
+	case <-p.done:
+		return p.code
+	default:
+		return 0
+	}
+}
+
+// readLoop 读取并解码客户端消息，无法解码的消息被忽略，连接出错时关闭
+func (p *peerImpl) readLoop() {
+	defer p.Close()
+
+	for {
+		data, err := p.frame.ReadFrame()
+		if err != nil {
+			return
+		}
+		msg := &Message{}
+		if err := p.codec.Unmarshal(data, msg); err != nil {
+			continue
+		}
+		select {
+		case p.out <- msg:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// writeLoop 发送队列中的消息，连接出错时关闭
+func (p *peerImpl) writeLoop() {
+	defer p.Close()
+
+	for {
+		select {
+		case <-p.queue.notify:
+			for {
+				f, ok := p.queue.pop()
+				if !ok {
+					break
+				}
+				if err := p.frame.WriteFrame(f.data, p.codec.Binary()); err != nil {
+					return
+				}
+			}
+		case <-p.done:
+			return
+		}
+	}
 }
@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	errPeerSlowConsumer = errors.New("peer slow consumer")
+)
+
+// SlowConsumerPolicy 客户端待发送队列超出限制时的处理策略
+type SlowConsumerPolicy int
+
+const (
+	SlowConsumerDrop       SlowConsumerPolicy = iota // 丢弃新消息
+	SlowConsumerCoalesce                             // 同一主题只保留最新消息，没有同主题消息时丢弃最早的消息
+	SlowConsumerDisconnect                           // 以 CloseCodeSlowConsumer 断开连接
+)
+
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case SlowConsumerDrop:
+		return "drop"
+	case SlowConsumerCoalesce:
+		return "coalesce"
+	case SlowConsumerDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// 超出限制的原因
+const (
+	SlowConsumerMaxPending      = "max_pending"
+	SlowConsumerMaxPendingBytes = "max_pending_bytes"
+)
+
+// CloseCodeSlowConsumer 因 SlowConsumerDisconnect 断开连接时的 WebSocket 关闭码（Policy Violation）
+const CloseCodeSlowConsumer = 1008
+
+// defaultPeerSendQueueBytes 客户端待发送队列的默认字节数上限
+const defaultPeerSendQueueBytes = 4 * 1024 * 1024
+
+// SlowConsumerEvent 客户端待发送队列超出限制，每次积压只在第一次超出时产生，队列清空后重新计算
+type SlowConsumerEvent struct {
+	PeerID       string `json:"peer_id"`
+	ClientID     string `json:"client_id"`
+	Identity     string `json:"identity"`
+	Policy       string `json:"policy"`
+	Reason       string `json:"reason"`
+	Pending      int    `json:"pending"`
+	PendingBytes int    `json:"pending_bytes"`
+	Dropped      uint64 `json:"dropped"` // 该客户端累计丢弃的消息数
+}
+
+type PeerOptions struct {
+	MaxPending      int                // 待发送消息数上限，默认 256
+	MaxPendingBytes int                // 待发送字节数上限，默认 4MB
+	SlowConsumer    SlowConsumerPolicy // 默认丢弃新消息
+	OnSlowConsumer  func(peer Peer, e SlowConsumerEvent)
+}
+
+type peerFrame struct {
+	topic string
+	data  []byte
+}
+
+// peerQueue 客户端待发送队列，保存编码后的消息
+type peerQueue struct {
+	mu       sync.Mutex
+	frames   []peerFrame
+	bytes    int
+	maxLen   int
+	maxBytes int
+	policy   SlowConsumerPolicy
+	slow     bool // 积压中，队列清空后重置
+	writing  bool // 取出的消息正在发送
+	dropped  uint64
+	notify   chan struct{}
+}
+
+func newPeerQueue(opts PeerOptions) *peerQueue {
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = defaultPeerSendQueue
+	}
+	if opts.MaxPendingBytes <= 0 {
+		opts.MaxPendingBytes = defaultPeerSendQueueBytes
+	}
+	return &peerQueue{
+		maxLen:   opts.MaxPending,
+		maxBytes: opts.MaxPendingBytes,
+		policy:   opts.SlowConsumer,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// push 将消息入队；超出限制时按策略处理，返回值 e 不为 nil 表示进入积压
+func (q *peerQueue) push(f peerFrame) (e *SlowConsumerEvent, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	reason := q.overflow(len(f.data))
+	if reason == "" {
+		q.append(f)
+		return nil, nil
+	}
+
+	if !q.slow {
+		q.slow = true
+		e = &SlowConsumerEvent{Policy: q.policy.String(), Reason: reason}
+	}
+	switch q.policy {
+	case SlowConsumerCoalesce:
+		q.coalesce(f)
+	case SlowConsumerDisconnect:
+		err = errPeerSlowConsumer
+	default:
+		q.dropped++
+		err = errPeerSendQueueFull
+	}
+	if e != nil {
+		e.Pending, e.PendingBytes, e.Dropped = len(q.frames), q.bytes, q.dropped
+	}
+	return e, err
+}
+
+// overflow 返回加入 n 字节的消息后超出的限制，未超出时返回空字符串
+func (q *peerQueue) overflow(n int) string {
+	switch {
+	case len(q.frames)+1 > q.maxLen:
+		return SlowConsumerMaxPending
+	case q.bytes+n > q.maxBytes:
+		return SlowConsumerMaxPendingBytes
+	default:
+		return ""
+	}
+}
+
+func (q *peerQueue) append(f peerFrame) {
+	q.frames = append(q.frames, f)
+	q.bytes += len(f.data)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// coalesce 替换同一主题最近的消息，否则丢弃最早的消息直到放得下
+func (q *peerQueue) coalesce(f peerFrame) {
+	for i := len(q.frames) - 1; i >= 0; i-- {
+		if q.frames[i].topic == f.topic {
+			q.bytes -= len(q.frames[i].data)
+			q.frames = append(q.frames[:i], q.frames[i+1:]...)
+			q.dropped++
+			break
+		}
+	}
+	for len(q.frames) > 0 && q.overflow(len(f.data)) != "" {
+		q.bytes -= len(q.frames[0].data)
+		q.frames[0] = peerFrame{}
+		q.frames = q.frames[1:]
+		q.dropped++
+	}
+	if q.overflow(len(f.data)) != "" {
+		// 单条消息超过字节数上限
+		q.dropped++
+		return
+	}
+	q.append(f)
+}
+
+// pop 取出最早的消息
+func (q *peerQueue) pop() (peerFrame, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.frames) == 0 {
+		q.slow = false
+		q.writing = false
+		return peerFrame{}, false
+	}
+	q.writing = true
+	f := q.frames[0]
+	q.frames[0] = peerFrame{}
+	q.frames = q.frames[1:]
+	q.bytes -= len(f.data)
+	return f, true
+}
+
+// idle 队列为空且没有正在发送的消息
+func (q *peerQueue) idle() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.frames) == 0 && !q.writing
+}
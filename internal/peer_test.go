@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testFrameConn is an in-memory FrameReadWriter.
+type testFrameConn struct {
+	reads  chan []byte
+	writes chan []byte
+
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newTestFrameConn() *testFrameConn {
+	return &testFrameConn{
+		reads:  make(chan []byte, 16),
+		writes: make(chan []byte, 16),
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *testFrameConn) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (c *testFrameConn) Write(p []byte) (int, error) { return len(p), nil }
+
+func (c *testFrameConn) ReadFrame() ([]byte, error) {
+	select {
+	case data, ok := <-c.reads:
+		if !ok {
+			return nil, io.EOF
+		}
+		return data, nil
+	case <-c.closed:
+		return nil, io.EOF
+	}
+}
+
+func (c *testFrameConn) WriteFrame(data []byte, binary bool) error {
+	select {
+	case c.writes <- data:
+		return nil
+	case <-c.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (c *testFrameConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestPeerReadWrite(t *testing.T) {
+	conn := newTestFrameConn()
+	peer := NewPeer(conn, jsonCodec{}, PeerInfo{ID: "p1"})
+	out := make(chan *Message)
+	if err := peer.Receive(out); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := peer.Receive(out); !errors.Is(err, errPeerAlreadySetReceiveChannel) {
+		t.Fatalf("Expected errPeerAlreadySetReceiveChannel, got %v", err)
+	}
+
+	conn.reads <- []byte("not json")
+	conn.reads <- []byte(`{"id":"1","topic":"chat","data":"hi"}`)
+	if msg := <-out; msg.ID != "1" || string(msg.Payload) != "hi" {
+		t.Fatalf("Unexpected message %+v", msg)
+	}
+
+	if err := peer.Send(&Message{ID: "2", Topic: "chat", Payload: []byte("hello")}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if data := <-conn.writes; string(data) != `{"id":"2","topic":"chat","data":"hello"}` {
+		t.Fatalf("Unexpected frame %s", data)
+	}
+
+	peer.Close()
+	<-peer.Done()
+	if err := peer.Send(&Message{}); !errors.Is(err, errPeerClosed) {
+		t.Fatalf("Expected errPeerClosed, got %v", err)
+	}
+}
+
+func TestPeerClosedOnReadError(t *testing.T) {
+	conn := newTestFrameConn()
+	peer := NewPeer(conn, jsonCodec{}, PeerInfo{})
+	peer.Receive(make(chan *Message))
+	close(conn.reads)
+
+	select {
+	case <-peer.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected peer to be closed")
+	}
+	select {
+	case <-conn.closed:
+	default:
+		t.Fatalf("Expected connection to be closed")
+	}
+}
+
+func TestPeerSendQueueFull(t *testing.T) {
+	conn := newTestFrameConn()
+	conn.writes = make(chan []byte) // never drained
+	peer := NewPeer(conn, jsonCodec{}, PeerInfo{})
+	defer peer.Close()
+
+	var err error
+	for i := 0; i < defaultPeerSendQueue+2 && err == nil; i++ {
+		err = peer.Send(&Message{})
+	}
+	if !errors.Is(err, errPeerSendQueueFull) {
+		t.Fatalf("Expected errPeerSendQueueFull, got %v", err)
+	}
+}
+
+func TestPeerOverWebSocket(t *testing.T) {
+	peers := make(chan Peer, 1)
+	received := make(chan *Message, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		sess := NewWSSession(r.Context(), conn, nil)
+		peer := NewPeer(sess, jsonCodec{}, PeerInfo{})
+		peer.Receive(received)
+		peers <- peer
+		<-peer.Done()
+	}))
+	defer server.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	peer := <-peers
+
+	client.WriteMessage(websocket.TextMessage, []byte(`{"id":"1","topic":"chat","data":{"text":"hi"}}`))
+	if msg := <-received; string(msg.Payload) != `{"text":"hi"}` {
+		t.Fatalf("Unexpected message %+v", msg)
+	}
+
+	peer.Send(&Message{ID: "2", Topic: "chat", Payload: []byte("hello")})
+	typ, data, err := client.ReadMessage()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if typ != websocket.TextMessage || string(data) != `{"id":"2","topic":"chat","data":"hello"}` {
+		t.Fatalf("Unexpected frame %d %s", typ, data)
+	}
+
+	client.Close()
+	select {
+	case <-peer.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected peer to be closed after the client disconnected")
+	}
+}
+
+func TestPeerQueueDrop(t *testing.T) {
+	q := newPeerQueue(PeerOptions{MaxPending: 2, MaxPendingBytes: 10})
+	push := func(topic, data string) (*SlowConsumerEvent, error) {
+		return q.push(peerFrame{topic: topic, data: []byte(data)})
+	}
+
+	push("a", "1")
+	push("a", "2")
+	e, err := push("a", "3")
+	if !errors.Is(err, errPeerSendQueueFull) || e == nil || e.Reason != SlowConsumerMaxPending {
+		t.Fatalf("Expected a max_pending event, got %+v, %v", e, err)
+	}
+	if e.Pending != 2 || e.Dropped != 1 || e.Policy != "drop" {
+		t.Fatalf("Unexpected event %+v", e)
+	}
+	// Only the first overflow of a backlog reports an event.
+	if e, err := push("a", "4"); e != nil || !errors.Is(err, errPeerSendQueueFull) {
+		t.Fatalf("Expected no event, got %+v, %v", e, err)
+	}
+	for _, ok := q.pop(); ok; _, ok = q.pop() {
+	}
+
+	push("a", "123456")
+	e, _ = push("a", "123456")
+	if e == nil || e.Reason != SlowConsumerMaxPendingBytes || e.PendingBytes != 6 || e.Dropped != 3 {
+		t.Fatalf("Expected a max_pending_bytes event, got %+v", e)
+	}
+}
+
+func TestPeerQueueCoalesce(t *testing.T) {
+	q := newPeerQueue(PeerOptions{MaxPending: 2, SlowConsumer: SlowConsumerCoalesce})
+	for _, f := range []peerFrame{{"x", []byte("x1")}, {"y", []byte("y1")}, {"x", []byte("x2")}} {
+		if _, err := q.push(f); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// No queued message has topic z, so the oldest one is dropped.
+	q.push(peerFrame{"z", []byte("z1")})
+
+	var got []string
+	for f, ok := q.pop(); ok; f, ok = q.pop() {
+		got = append(got, string(f.data))
+	}
+	if len(got) != 2 || got[0] != "x2" || got[1] != "z1" || q.dropped != 2 {
+		t.Fatalf("Unexpected queue %v with %d dropped", got, q.dropped)
+	}
+}
+
+type testCloseCodeConn struct {
+	*testFrameConn
+	code chan int
+}
+
+func (c *testCloseCodeConn) CloseWithCode(code int, text string) error {
+	c.code <- code
+	return c.Close()
+}
+
+func TestPeerSlowConsumerDisconnect(t *testing.T) {
+	conn := &testCloseCodeConn{testFrameConn: newTestFrameConn(), code: make(chan int, 1)}
+	conn.writes = make(chan []byte) // never drained
+	var events []SlowConsumerEvent
+	peer := NewPeerWithOptions(conn, jsonCodec{}, PeerInfo{ID: "p1"}, PeerOptions{
+		MaxPending:   1,
+		SlowConsumer: SlowConsumerDisconnect,
+		OnSlowConsumer: func(peer Peer, e SlowConsumerEvent) {
+			events = append(events, e)
+		},
+	})
+
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = peer.Send(&Message{})
+	}
+	if !errors.Is(err, errPeerSlowConsumer) {
+		t.Fatalf("Expected errPeerSlowConsumer, got %v", err)
+	}
+	if code := <-conn.code; code != CloseCodeSlowConsumer {
+		t.Fatalf("Expected close code %d, got %d", CloseCodeSlowConsumer, code)
+	}
+	<-peer.Done()
+	if len(events) != 1 || events[0].PeerID != "p1" || events[0].Policy != "disconnect" {
+		t.Fatalf("Unexpected events %+v", events)
+	}
+	if err := peer.Send(&Message{}); !errors.Is(err, errPeerClosed) {
+		t.Fatalf("Expected errPeerClosed, got %v", err)
+	}
+}
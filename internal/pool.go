@@ -1,16 +1,21 @@
 package internal
 
-import "sync"
+import (
+	"fmt"
+	"sync"
+)
 
 type ListPeerOption struct {
-	Limit int
+	Limit   int
+	Service string // 只列出该业务系统的客户端，为空时不过滤
 }
 
 type cometPool struct {
-	peersMu    sync.RWMutex
-	peers      map[string]Peer
-	servicesMu sync.RWMutex
-	services   map[string]Service
+	peersMu      sync.RWMutex
+	peers        map[string]Peer
+	servicePeers map[string]int // 各业务系统的客户端数
+	servicesMu   sync.RWMutex
+	services     map[string]Service
 }
 
 func (p *cometPool) GetPeer(id string) (Peer, bool) {
@@ -27,27 +32,66 @@ func (p *cometPool) ListPeer(option ListPeerOption) []Peer {
 
 	peers := make([]Peer, 0, len(p.peers))
 	for _, peer := range p.peers {
+		if option.Service != "" && peer.Info().Service != option.Service {
+			continue
+		}
 		peers = append(peers, peer)
 	}
 	return peers
 }
 
-func (p *cometPool) AddPeer(peer Peer) error {
+// AddPeer 登记客户端，业务系统的客户端数不能超过其 MaxPeers；
+// 持有 servicesMu 检查 service 仍已登记，RemoveService 之后列出的客户端一定包含此前登记的客户端
+func (p *cometPool) AddPeer(peer Peer, service Service) error {
+	p.servicesMu.RLock()
+	defer p.servicesMu.RUnlock()
 	p.peersMu.Lock()
 	defer p.peersMu.Unlock()
 
-	p.peers[peer.Info().ID] = peer
+	info := peer.Info()
+	if p.services[info.Service] != service {
+		return errServiceNotAvailable
+	}
+	if _, ok := p.peers[info.ID]; ok {
+		return nil
+	}
+	if max := service.Info().MaxPeers; max > 0 && p.servicePeers[info.Service] >= max {
+		return errServiceFull
+	}
+	p.peers[info.ID] = peer
+	p.servicePeers[info.Service]++
 	return nil
 }
 
-func (p *cometPool) RemovePeer(id string) {
+// RemovePeer 移除客户端，返回客户端是否存在
+func (p *cometPool) RemovePeer(id string) bool {
 	p.peersMu.Lock()
 	defer p.peersMu.Unlock()
 
+	peer, ok := p.peers[id]
+	if !ok {
+		return false
+	}
 	delete(p.peers, id)
+	service := peer.Info().Service
+	if p.servicePeers[service]--; p.servicePeers[service] <= 0 {
+		delete(p.servicePeers, service)
+	}
+	return true
+}
+
+// CountServicePeer 业务系统的客户端数
+func (p *cometPool) CountServicePeer(service string) int {
+	p.peersMu.RLock()
+	defer p.peersMu.RUnlock()
+
+	return p.servicePeers[service]
 }
 
 func (p *cometPool) CountPeer() int {
+	p.peersMu.RLock()
+	defer p.peersMu.RUnlock()
+
 	return len(p.peers)
 }
 
@@ -70,11 +114,21 @@ func (p *cometPool) ListService(option ListPeerOption) []Service {
 	return services
 }
 
+// AddService 登记业务系统，名称已存在或主题前缀与已有业务系统重叠时返回 errServiceExists
 func (p *cometPool) AddService(service Service) error {
 	p.servicesMu.Lock()
 	defer p.servicesMu.Unlock()
 
-	p.services[service.Info().Name] = service
+	info := service.Info()
+	for name, other := range p.services {
+		if name == info.Name {
+			return fmt.Errorf("%w: %q", errServiceExists, name)
+		}
+		if info.overlaps(other.Info()) {
+			return fmt.Errorf("%w: namespace %q overlaps %q", errServiceExists, info.namespace(), name)
+		}
+	}
+	p.services[info.Name] = service
 	return nil
 }
 
@@ -86,6 +140,9 @@ func (p *cometPool) RemoveService(service Service) {
 }
 
 func (p *cometPool) CountService() int {
+	p.servicesMu.RLock()
+	defer p.servicesMu.RUnlock()
+
 	return len(p.services)
 }
 
@@ -129,5 +186,8 @@ func (p *servicePool) RemoveSession(id string) {
 }
 
 func (p *servicePool) CountSession() int {
+	p.sessionsMu.RLock()
+	defer p.sessionsMu.RUnlock()
+
 	return len(p.sessions)
 }
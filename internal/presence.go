@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// EventPresence 客户端上下线事件，发布到 ServiceInfo.EventTopic(EventPresence)，data 为 PresenceEvent
+const EventPresence = "presence"
+
+// 上下线事件类型
+const (
+	PresenceOnline    = "online"
+	PresenceOffline   = "offline"
+	PresenceReconnect = "reconnect" // 同一客户端下线后 ReconnectWindow 内重新上线
+)
+
+// 下线原因
+const (
+	PresenceReasonDisconnect   = "disconnect"    // 客户端断开或网络错误
+	PresenceReasonRemoved      = "removed"       // 由 Comet.RemovePeer 移除
+	PresenceReasonSlowConsumer = "slow_consumer" // 因积压被断开
+	PresenceReasonShutdown     = "shutdown"      // 服务关闭
+)
+
+// defaultReconnectWindow 下线后多久内上线视为重连
+const defaultReconnectWindow = 30 * time.Second
+
+type PresenceEvent struct {
+	Type     string `json:"type"`
+	PeerID   string `json:"peer_id"`
+	ClientID string `json:"client_id"`
+	Identity string `json:"identity"`
+	IP       string `json:"ip"`
+	Reason   string `json:"reason,omitempty"` // 下线原因
+	Time     int64  `json:"time"`             // Unix 毫秒
+}
+
+// key 识别同一客户端，用于判断重连；没有客户端ID和用户标识时使用连接ID
+func (e PresenceEvent) key() string {
+	if e.Identity == "" && e.ClientID == "" {
+		return e.PeerID
+	}
+	return e.Identity + "\x00" + e.ClientID
+}
+
+// PresenceNotifier 业务系统实现该接口时，Comet 发布上下线事件后调用 NotifyPresence，实现不能阻塞
+type PresenceNotifier interface {
+	NotifyPresence(e PresenceEvent)
+}
+
+// peerCloseCoder 可以查询关闭码的客户端，如 peerImpl
+type peerCloseCoder interface {
+	closeCode() int
+}
+
+// peerCloseReason 根据关闭码判断已关闭客户端的下线原因
+func peerCloseReason(peer Peer) string {
+	c, ok := peer.(peerCloseCoder)
+	if !ok {
+		return PresenceReasonDisconnect
+	}
+	switch c.closeCode() {
+	case CloseCodeSlowConsumer:
+		return PresenceReasonSlowConsumer
+	case websocket.CloseGoingAway:
+		return PresenceReasonShutdown
+	default:
+		return PresenceReasonDisconnect
+	}
+}
+
+// presenceTracker 记录最近下线的客户端，用于识别重连
+type presenceTracker struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	offline   map[string]time.Time
+	lastPrune time.Time
+}
+
+func newPresenceTracker(window time.Duration) *presenceTracker {
+	if window <= 0 {
+		window = defaultReconnectWindow
+	}
+	return &presenceTracker{
+		window:  window,
+		offline: make(map[string]time.Time),
+	}
+}
+
+// online 返回客户端是否在 window 内下线过
+func (t *presenceTracker) online(key string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	at, ok := t.offline[key]
+	delete(t.offline, key)
+	return ok && now.Sub(at) <= t.window
+}
+
+func (t *presenceTracker) setOffline(key string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.offline[key] = now
+	// 每个 window 最多清理一次过期记录
+	if now.Sub(t.lastPrune) > t.window {
+		for k, at := range t.offline {
+			if now.Sub(at) > t.window {
+				delete(t.offline, k)
+			}
+		}
+		t.lastPrune = now
+	}
+}
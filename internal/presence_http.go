@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type PresenceCallbackOptions struct {
+	Client        *http.Client  // 默认 http.DefaultClient
+	Timeout       time.Duration // 单次请求超时，默认 3s
+	BatchSize     int           // 每次回调最多包含的事件数，默认 100
+	BatchInterval time.Duration // 事件最多等待多久发送，默认 1s
+	Retries       int           // 回调失败后的重试次数，默认 3，小于 0 时不重试
+	RetryBackoff  time.Duration // 重试间隔，每次翻倍，默认 500ms
+	MaxPending    int           // 待发送事件数上限，超出时丢弃新事件，默认 10000
+}
+
+// presenceBatch 上下线回调的请求体
+type presenceBatch struct {
+	Events []PresenceEvent `json:"events"`
+}
+
+// PresenceCallback 将上下线事件批量回调到业务系统，见 openapi/comet.yaml 中的 {online_callback_addr}；
+// 连接在一批内上线后又下线时，上线与下线事件一起丢弃，业务系统不会收到没有上线的下线事件，
+// 避免网络抖动时频繁回调；不同连接的事件不会合并，即使属于同一用户，以免新连接上线与旧连接下线相互覆盖
+type PresenceCallback struct {
+	url    string
+	client *http.Client
+	opts   PresenceCallbackOptions
+
+	mu      sync.Mutex
+	pending []PresenceEvent
+	index   map[string]int // 连接在 pending 中的位置
+	dropped uint64
+
+	notify chan struct{}
+	once   sync.Once
+	closed chan struct{}
+	done   chan struct{}
+}
+
+func NewPresenceCallback(url string) *PresenceCallback {
+	return NewPresenceCallbackWithOptions(url, PresenceCallbackOptions{})
+}
+
+func NewPresenceCallbackWithOptions(url string, opts PresenceCallbackOptions) *PresenceCallback {
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 3 * time.Second
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.BatchInterval <= 0 {
+		opts.BatchInterval = time.Second
+	}
+	if opts.Retries < 0 {
+		opts.Retries = 0
+	} else if opts.Retries == 0 {
+		opts.Retries = 3
+	}
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = 500 * time.Millisecond
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = 10000
+	}
+	client := *opts.Client
+	client.Timeout = opts.Timeout
+
+	p := &PresenceCallback{
+		url:    url,
+		client: &client,
+		opts:   opts,
+		index:  make(map[string]int),
+		notify: make(chan struct{}, 1),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Notify 将事件加入待发送队列，不会阻塞
+func (p *PresenceCallback) Notify(e PresenceEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.closed:
+		p.dropped++
+		return
+	default:
+	}
+
+	if i, ok := p.index[e.PeerID]; ok {
+		if e.Type == PresenceOffline && p.pending[i].Type != PresenceOffline {
+			p.remove(i)
+		} else {
+			p.pending[i] = e
+		}
+		return
+	}
+	if len(p.pending) >= p.opts.MaxPending {
+		p.dropped++
+		return
+	}
+	p.index[e.PeerID] = len(p.pending)
+	p.pending = append(p.pending, e)
+	if len(p.pending) >= p.opts.BatchSize {
+		select {
+		case p.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// remove 从待发送队列中移除第 i 个事件
+func (p *PresenceCallback) remove(i int) {
+	delete(p.index, p.pending[i].PeerID)
+	p.pending = append(p.pending[:i], p.pending[i+1:]...)
+	for _, e := range p.pending[i:] {
+		p.index[e.PeerID]--
+	}
+}
+
+// Dropped 因队列已满或回调失败丢弃的事件数
+func (p *PresenceCallback) Dropped() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dropped
+}
+
+// Close 发送剩余事件后停止，关闭后的事件被丢弃
+func (p *PresenceCallback) Close() error {
+	p.once.Do(func() {
+		close(p.closed)
+	})
+	<-p.done
+	return nil
+}
+
+func (p *PresenceCallback) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.opts.BatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.notify:
+		case <-p.closed:
+			p.flush()
+			return
+		}
+		p.flush()
+	}
+}
+
+// flush 按 BatchSize 分批发送所有待发送事件
+func (p *PresenceCallback) flush() {
+	p.mu.Lock()
+	events := p.pending
+	p.pending = nil
+	p.index = make(map[string]int)
+	p.mu.Unlock()
+
+	for len(events) > 0 {
+		n := len(events)
+		if n > p.opts.BatchSize {
+			n = p.opts.BatchSize
+		}
+		if err := p.send(events[:n]); err != nil {
+			p.mu.Lock()
+			p.dropped += uint64(n)
+			p.mu.Unlock()
+		}
+		events = events[n:]
+	}
+}
+
+// send 发送一批事件，失败时按 RetryBackoff 重试；关闭后不再等待重试
+func (p *PresenceCallback) send(events []PresenceEvent) error {
+	body, err := json.Marshal(presenceBatch{Events: events})
+	if err != nil {
+		return err
+	}
+
+	backoff := p.opts.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err = p.post(body)
+		if err == nil || attempt >= p.opts.Retries {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-p.closed:
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+func (p *PresenceCallback) post(body []byte) error {
+	resp, err := p.client.Post(p.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("presence callback: status %d", resp.StatusCode)
+	}
+	return nil
+}
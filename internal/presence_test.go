@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testPresenceService struct {
+	*testService
+	events chan PresenceEvent
+}
+
+func (s *testPresenceService) NotifyPresence(e PresenceEvent) {
+	s.events <- e
+}
+
+func TestCometPresence(t *testing.T) {
+	m := NewStandAloneMessaging().(*standAloneImpl)
+	c := NewComet(m)
+	service := &testPresenceService{testService: &testService{info: ServiceInfo{Name: "chat"}}, events: make(chan PresenceEvent, 8)}
+	c.pool.AddService(service)
+
+	published := make(chan Message, 8)
+	m.Subscribe(service.info.EventTopic(EventPresence), func(topic string, message Message) {
+		published <- message
+	})
+
+	addPeer := func() (Peer, *testFrameConn) {
+		conn := newTestFrameConn()
+		peer, err := c.NewPeer(conn, PeerInfo{Service: "chat", ClientID: "c1", IP: "10.0.0.1", ServiceToken: "1000"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := c.AddPeer(peer); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return peer, conn
+	}
+	expect := func(peer Peer, typ, reason string) {
+		t.Helper()
+		e := <-service.events
+		if e.Type != typ || e.Reason != reason || e.PeerID != peer.Info().ID || e.Identity != "1000" || e.IP != "10.0.0.1" {
+			t.Fatalf("Expected %s %s, got %+v", typ, reason, e)
+		}
+		msg := <-published
+		var got PresenceEvent
+		json.Unmarshal(msg.Payload, &got)
+		if msg.Topic != EventPresence || msg.Identity != "1000" || got != e {
+			t.Fatalf("Unexpected message %+v", msg)
+		}
+	}
+
+	peer, conn := addPeer()
+	expect(peer, PresenceOnline, "")
+	conn.Close()
+	expect(peer, PresenceOffline, PresenceReasonDisconnect)
+
+	// The same client comes back within the reconnect window.
+	peer, _ = addPeer()
+	expect(peer, PresenceReconnect, "")
+	c.RemovePeer(peer)
+	expect(peer, PresenceOffline, PresenceReasonRemoved)
+
+	// Removing the peer again does not repeat the event.
+	c.RemovePeer(peer)
+	select {
+	case e := <-service.events:
+		t.Fatalf("Unexpected event %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPresenceCallbackBatch(t *testing.T) {
+	batches := make(chan []PresenceEvent, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch presenceBatch
+		json.NewDecoder(r.Body).Decode(&batch)
+		batches <- batch.Events
+	}))
+	defer server.Close()
+
+	p := NewPresenceCallbackWithOptions(server.URL, PresenceCallbackOptions{BatchInterval: time.Hour, BatchSize: 3})
+	// Connections that come and go within a batch are not reported at all, while
+	// a new tab of the same user coming online is reported on its own.
+	p.Notify(PresenceEvent{Type: PresenceOnline, PeerID: "p1", Identity: "1000"})
+	p.Notify(PresenceEvent{Type: PresenceOnline, PeerID: "p2", Identity: "1000"})
+	p.Notify(PresenceEvent{Type: PresenceReconnect, PeerID: "p3", Identity: "2000"})
+	p.Notify(PresenceEvent{Type: PresenceOffline, PeerID: "p1", Identity: "1000"})
+	p.Notify(PresenceEvent{Type: PresenceOffline, PeerID: "p3", Identity: "2000"})
+	// p0 came online in an earlier batch, so its offline event is kept.
+	p.Notify(PresenceEvent{Type: PresenceOffline, PeerID: "p0", Identity: "1000"})
+	p.Notify(PresenceEvent{Type: PresenceOnline, PeerID: "p4", Identity: "2000"})
+
+	batch := <-batches
+	if len(batch) != 3 || batch[0].PeerID != "p2" || batch[0].Type != PresenceOnline ||
+		batch[1].PeerID != "p0" || batch[1].Type != PresenceOffline || batch[2].PeerID != "p4" {
+		t.Fatalf("Unexpected batch %+v", batch)
+	}
+
+	// Close flushes the remaining events.
+	p.Notify(PresenceEvent{Type: PresenceOffline, PeerID: "p4", Identity: "2000"})
+	p.Close()
+	if batch := <-batches; len(batch) != 1 || batch[0].Type != PresenceOffline {
+		t.Fatalf("Unexpected batch %+v", batch)
+	}
+	p.Notify(PresenceEvent{PeerID: "p5"})
+	if p.Dropped() != 1 {
+		t.Fatalf("Expected events after close to be dropped, got %d", p.Dropped())
+	}
+}
+
+func TestPresenceCallbackRetry(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	p := NewPresenceCallbackWithOptions(server.URL, PresenceCallbackOptions{
+		BatchInterval: 10 * time.Millisecond,
+		Retries:       2,
+		RetryBackoff:  time.Millisecond,
+	})
+	p.Notify(PresenceEvent{Type: PresenceOnline, PeerID: "p1"})
+	waitFor(t, func() bool { return atomic.LoadInt32(&calls) == 3 })
+	p.Close()
+	if p.Dropped() != 0 {
+		t.Fatalf("Expected the retry to succeed, got %d dropped", p.Dropped())
+	}
+
+	p = NewPresenceCallbackWithOptions(server.URL, PresenceCallbackOptions{Retries: -1})
+	atomic.StoreInt32(&calls, 0)
+	p.Notify(PresenceEvent{Type: PresenceOnline, PeerID: "p1"})
+	p.Close()
+	if p.Dropped() != 1 || atomic.LoadInt32(&calls) != 1 {
+		t.Fatalf("Expected the failed batch to be dropped, got %d dropped after %d calls", p.Dropped(), atomic.LoadInt32(&calls))
+	}
+}
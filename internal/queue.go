@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"sync/atomic"
+)
+
+var (
+	errQueueStrategyConflict = errors.New("queue strategy conflicts with existing queue members")
+)
+
+// QueueStrategy 队列组负载均衡策略
+type QueueStrategy int
+
+const (
+	QueueRandom        QueueStrategy = iota // 随机
+	QueueRoundRobin                         // 轮询
+	QueueLeastInFlight                      // 处理中消息最少
+	QueueWeighted                           // 按权重随机
+	QueueSticky                             // 按消息键一致性哈希，同一键总是投递给同一订阅者
+)
+
+func (s QueueStrategy) String() string {
+	switch s {
+	case QueueRandom:
+		return "random"
+	case QueueRoundRobin:
+		return "round_robin"
+	case QueueLeastInFlight:
+		return "least_in_flight"
+	case QueueWeighted:
+		return "weighted"
+	case QueueSticky:
+		return "sticky"
+	default:
+		return "unknown"
+	}
+}
+
+// QueueKeyFunc 计算消息键，用于 QueueSticky
+type QueueKeyFunc func(msg *Message) string
+
+// DefaultQueueKey 按业务系统和用户标识计算消息键，使同一用户的消息总是由同一个订阅者处理
+func DefaultQueueKey(msg *Message) string {
+	return msg.Service + "." + msg.Identity
+}
+
+// WithQueueStrategy 指定队列组的负载均衡策略，同一队列组的订阅者必须使用相同策略，默认随机
+func WithQueueStrategy(strategy QueueStrategy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.strategy = strategy
+		o.strategySet = true
+	}
+}
+
+// WithQueueWeight 指定订阅者权重，用于 QueueWeighted，默认为1
+func WithQueueWeight(weight int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.weight = weight
+	}
+}
+
+// WithQueueKey 指定消息键，同时使用 QueueSticky 策略
+func WithQueueKey(key QueueKeyFunc) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.strategy = QueueSticky
+		o.strategySet = true
+		o.key = key
+	}
+}
+
+// queueBalancer 从队列组中选出接收消息的订阅者，members 不为空
+type queueBalancer interface {
+	pick(members []*subscription, msg *Message) *subscription
+}
+
+func newQueueBalancer(o subscribeOptions) queueBalancer {
+	switch o.strategy {
+	case QueueRoundRobin:
+		return &roundRobinBalancer{}
+	case QueueLeastInFlight:
+		return leastInFlightBalancer{}
+	case QueueWeighted:
+		return weightedBalancer{}
+	case QueueSticky:
+		return stickyBalancer{key: o.key}
+	default:
+		return randomBalancer{}
+	}
+}
+
+type randomBalancer struct{}
+
+func (randomBalancer) pick(members []*subscription, msg *Message) *subscription {
+	return members[rand.Intn(len(members))]
+}
+
+type roundRobinBalancer struct {
+	next uint64
+}
+
+func (b *roundRobinBalancer) pick(members []*subscription, msg *Message) *subscription {
+	n := atomic.AddUint64(&b.next, 1) - 1
+	return members[n%uint64(len(members))]
+}
+
+type leastInFlightBalancer struct{}
+
+func (leastInFlightBalancer) pick(members []*subscription, msg *Message) *subscription {
+	best := members[0]
+	bestInFlight := atomic.LoadInt64(&best.inFlight)
+	for _, s := range members[1:] {
+		if n := atomic.LoadInt64(&s.inFlight); n < bestInFlight {
+			best, bestInFlight = s, n
+		}
+	}
+	return best
+}
+
+type weightedBalancer struct{}
+
+func (weightedBalancer) pick(members []*subscription, msg *Message) *subscription {
+	total := 0
+	for _, s := range members {
+		total += s.weight
+	}
+	n := rand.Intn(total)
+	for _, s := range members {
+		if n < s.weight {
+			return s
+		}
+		n -= s.weight
+	}
+	return members[len(members)-1]
+}
+
+// stickyBalancer 使用最高随机权重（rendezvous）哈希，订阅者增减时只有其负责的键会被重新分配
+type stickyBalancer struct {
+	key QueueKeyFunc
+}
+
+func (b stickyBalancer) pick(members []*subscription, msg *Message) *subscription {
+	key := b.key(msg)
+	var best *subscription
+	var bestScore uint64
+	for _, s := range members {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(s.sid))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = s, score
+		}
+	}
+	return best
+}
+
+// queueKey 队列组按订阅主题与队列名区分
+type queueKey struct {
+	topicPattern string
+	queue        string
+}
+
+// queueGroup 记录队列组的负载均衡策略，最后一个订阅者取消订阅时删除
+type queueGroup struct {
+	strategy QueueStrategy
+	balancer queueBalancer
+	members  int
+}
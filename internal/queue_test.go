@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func newTestMembers(n int) []*subscription {
+	members := make([]*subscription, n)
+	for i := range members {
+		members[i] = &subscription{sid: fmt.Sprintf("sid-%d", i), weight: 1}
+	}
+	return members
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	members := newTestMembers(3)
+	b := newQueueBalancer(newSubscribeOptions([]SubscribeOption{WithQueueStrategy(QueueRoundRobin)}))
+	for i := 0; i < 9; i++ {
+		if s := b.pick(members, &Message{}); s != members[i%3] {
+			t.Fatalf("Pick %d returned %s, expected %s", i, s.sid, members[i%3].sid)
+		}
+	}
+}
+
+func TestLeastInFlightBalancer(t *testing.T) {
+	members := newTestMembers(3)
+	members[0].inFlight = 5
+	members[1].inFlight = 1
+	members[2].inFlight = 3
+	b := newQueueBalancer(newSubscribeOptions([]SubscribeOption{WithQueueStrategy(QueueLeastInFlight)}))
+	if s := b.pick(members, &Message{}); s != members[1] {
+		t.Fatalf("Expected %s, got %s", members[1].sid, s.sid)
+	}
+}
+
+func TestWeightedBalancer(t *testing.T) {
+	members := newTestMembers(2)
+	members[0].weight = 9
+	b := newQueueBalancer(newSubscribeOptions([]SubscribeOption{WithQueueStrategy(QueueWeighted)}))
+	counts := make(map[*subscription]int)
+	for i := 0; i < 10000; i++ {
+		counts[b.pick(members, &Message{})]++
+	}
+	if counts[members[0]] < 8500 || counts[members[1]] < 500 {
+		t.Fatalf("Unexpected weighted distribution: %d vs %d", counts[members[0]], counts[members[1]])
+	}
+}
+
+func TestStickyBalancer(t *testing.T) {
+	members := newTestMembers(4)
+	b := newQueueBalancer(newSubscribeOptions([]SubscribeOption{WithQueueKey(DefaultQueueKey)}))
+
+	picked := make(map[string]*subscription)
+	used := make(map[*subscription]bool)
+	for i := 0; i < 100; i++ {
+		msg := &Message{Service: "chat", Identity: fmt.Sprint(i)}
+		s := b.pick(members, msg)
+		for j := 0; j < 3; j++ {
+			if b.pick(members, msg) != s {
+				t.Fatalf("Identity %s is not sticky", msg.Identity)
+			}
+		}
+		picked[msg.Identity] = s
+		used[s] = true
+	}
+	if len(used) != len(members) {
+		t.Fatalf("Expected keys spread over %d members, got %d", len(members), len(used))
+	}
+
+	// Removing a member only moves the keys it was responsible for.
+	removed := members[1]
+	remaining := []*subscription{members[0], members[2], members[3]}
+	for identity, s := range picked {
+		ns := b.pick(remaining, &Message{Service: "chat", Identity: identity})
+		if s != removed && ns != s {
+			t.Fatalf("Identity %s moved from %s to %s", identity, s.sid, ns.sid)
+		}
+	}
+}
+
+func TestMessagingQueueStrategies(t *testing.T) {
+	m := NewStandAloneMessaging()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	received := make(map[string][]int)
+	for i := 0; i < 3; i++ {
+		i := i
+		_, err := m.QueueSubscribe("$.service.chat.sub", "workers", func(topic string, message Message) {
+			mu.Lock()
+			received[message.Identity] = append(received[message.Identity], i)
+			mu.Unlock()
+			wg.Done()
+		}, WithQueueKey(DefaultQueueKey))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	_, err := m.QueueSubscribe("$.service.chat.sub", "workers", func(topic string, message Message) {},
+		WithQueueStrategy(QueueRoundRobin))
+	if !errors.Is(err, errQueueStrategyConflict) {
+		t.Fatalf("Expected errQueueStrategyConflict, got %v", err)
+	}
+
+	wg.Add(10 * 5)
+	for i := 0; i < 10; i++ {
+		for identity := 0; identity < 5; identity++ {
+			msg := Message{Service: "chat", Identity: fmt.Sprint(identity)}
+			if err := m.Publish("$.service.chat.sub", msg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+	}
+	wg.Wait()
+	for identity, workers := range received {
+		for _, w := range workers {
+			if w != workers[0] {
+				t.Fatalf("Identity %s was delivered to workers %v", identity, workers)
+			}
+		}
+	}
+}
+
+func TestMessagingQueueGroupReleased(t *testing.T) {
+	m := NewStandAloneMessaging().(*standAloneImpl)
+	handler := func(topic string, message Message) {}
+
+	sub, _ := m.QueueSubscribe("a", "q", handler, WithQueueStrategy(QueueRoundRobin))
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	if len(m.queues) != 0 {
+		t.Fatalf("Expected queue group to be released, got %d", len(m.queues))
+	}
+	// Once released, the queue can use another strategy.
+	if _, err := m.QueueSubscribe("a", "q", handler, WithQueueStrategy(QueueWeighted)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := m.QueueSubscribe("a..b", "q", handler); !errors.Is(err, ErrInvalidSubject) {
+		t.Fatalf("Expected ErrInvalidSubject, got %v", err)
+	}
+	if g := m.queues[queueKey{topicPattern: "a", queue: "q"}]; g.members != 1 {
+		t.Fatalf("Expected 1 queue member, got %d", g.members)
+	}
+}
+
+func TestMessagingQueueGroupPerTopic(t *testing.T) {
+	m := NewStandAloneMessaging()
+
+	received := make(chan int, 8)
+	for i := 0; i < 2; i++ {
+		i := i
+		if _, err := m.QueueSubscribe("$.service.chat.sub", "default", func(topic string, message Message) {
+			received <- i
+		}, WithQueueKey(DefaultQueueKey)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// The same queue name on another topic may use its own strategy.
+	var other []int
+	for i := 0; i < 2; i++ {
+		i := i
+		if _, err := m.QueueSubscribe("news", "default", func(topic string, message Message) {
+			received <- 10 + i
+		}, WithQueueStrategy(QueueRoundRobin)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		m.Publish("news", Message{})
+		other = append(other, <-received)
+	}
+	if other[0] == other[1] || other[0] != other[2] || other[1] != other[3] {
+		t.Fatalf("Expected round robin delivery, got %v", other)
+	}
+}
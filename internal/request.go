@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrNoResponders = errors.New("no responders")
+)
+
+// InboxPrefix 回复主题前缀
+const InboxPrefix = "_INBOX."
+
+// NewInbox 生成唯一的回复主题
+func NewInbox() string {
+	return InboxPrefix + genId()
+}
+
+func (m *standAloneImpl) Request(ctx context.Context, topic string, msg Message) (Message, error) {
+	msgs, err := m.RequestMany(ctx, topic, msg, 1)
+	if err != nil {
+		return Message{}, err
+	}
+	return msgs[0], nil
+}
+
+func (m *standAloneImpl) RequestMany(ctx context.Context, topic string, msg Message, max int) ([]Message, error) {
+	r, err := m.sublist.MatchResult(topic)
+	if err != nil {
+		return nil, err
+	}
+	if r.Fanout() == 0 {
+		return nil, ErrNoResponders
+	}
+
+	replies := make(chan Message, defaultMaxPending)
+	done := make(chan struct{})
+	defer close(done)
+	inbox := NewInbox()
+	sub, err := m.Subscribe(inbox, func(topic string, message Message) {
+		select {
+		case replies <- message:
+		case <-done:
+		}
+	}, WithOverflowPolicy(OverflowBlock))
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	msg.Reply = inbox
+	if err := m.Publish(topic, msg); err != nil {
+		return nil, err
+	}
+
+	var msgs []Message
+	for max <= 0 || len(msgs) < max {
+		select {
+		case reply := <-replies:
+			msgs = append(msgs, reply)
+		case <-ctx.Done():
+			if len(msgs) == 0 {
+				return nil, ctx.Err()
+			}
+			return msgs, nil
+		}
+	}
+	return msgs, nil
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestRequest(t *testing.T) {
+	m := NewStandAloneMessaging()
+	m.Subscribe("history.load", func(topic string, message Message) {
+		m.Publish(message.Reply, Message{Payload: append([]byte("re: "), message.Payload...)})
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := m.Request(ctx, "history.load", Message{Payload: []byte("1000")})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(reply.Payload) != "re: 1000" {
+		t.Fatalf("Unexpected reply %q", reply.Payload)
+	}
+	if m.(*standAloneImpl).sublist.Count() != 1 {
+		t.Fatalf("Expected inbox subscription to be removed")
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	m := NewStandAloneMessaging()
+	ctx := context.Background()
+	if _, err := m.Request(ctx, "nobody", Message{}); !errors.Is(err, ErrNoResponders) {
+		t.Fatalf("Expected ErrNoResponders, got %v", err)
+	}
+	if _, err := m.Request(ctx, "a.*", Message{}); !errors.Is(err, ErrInvalidSubject) {
+		t.Fatalf("Expected ErrInvalidSubject, got %v", err)
+	}
+
+	m.Subscribe("silent", func(topic string, message Message) {})
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := m.Request(ctx, "silent", Message{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestRequestMany(t *testing.T) {
+	m := NewStandAloneMessaging()
+	for _, id := range []string{"a", "b", "c"} {
+		id := id
+		m.Subscribe("scatter", func(topic string, message Message) {
+			m.Publish(message.Reply, Message{ID: id})
+		})
+	}
+	// Only one member of a queue group responds.
+	for i := 0; i < 2; i++ {
+		m.QueueSubscribe("scatter", "q", func(topic string, message Message) {
+			m.Publish(message.Reply, Message{ID: "q"})
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	replies, err := m.RequestMany(ctx, "scatter", Message{}, 4)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ids := make([]string, len(replies))
+	for i, r := range replies {
+		ids[i] = r.ID
+	}
+	sort.Strings(ids)
+	if len(ids) != 4 || ids[0] != "a" || ids[1] != "b" || ids[2] != "c" || ids[3] != "q" {
+		t.Fatalf("Unexpected replies %v", ids)
+	}
+
+	// Without a limit, responses are gathered until the context ends.
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	replies, err = m.RequestMany(ctx, "scatter", Message{}, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(replies) != 4 {
+		t.Fatalf("Expected 4 replies, got %d", len(replies))
+	}
+}
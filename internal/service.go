@@ -1,8 +1,28 @@
 package internal
 
 import (
+	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	errTopicNotAllowed    = errors.New("topic not allowed")
+	errServiceInvalid     = errors.New("invalid service")
+	errServiceExists      = errors.New("service already registered")
+	errServiceFull        = errors.New("service connection limit reached")
+	errWorkerUnauthorized = errors.New("worker unauthorized")
+
+	// ErrAuthUnavailable 业务系统认证服务不可用，Service.Auth 返回该错误时客户端收到 503 而不是 401
+	ErrAuthUnavailable = errors.New("auth service unavailable")
 )
 
 type IndexEntry map[string]string
@@ -13,6 +33,18 @@ type ServiceIdentity struct {
 	ExtraInfo   interface{} `json:"extra_info"`   // 业务系统用户额外信息（不可搜索）
 }
 
+// AuthRequest 客户端认证信息
+type AuthRequest struct {
+	ClientID string `json:"client_id"`
+	Token    string `json:"token"`
+	IP       string `json:"ip"`
+}
+
+// Authenticator 认证客户端，认证服务不可用时返回 ErrAuthUnavailable
+type Authenticator interface {
+	Auth(ctx context.Context, req AuthRequest) (ServiceIdentity, error)
+}
+
 type ServiceWorkerInfo struct {
 	ID string
 }
@@ -21,14 +53,79 @@ type ServiceWorker interface {
 	Info() ServiceWorkerInfo
 	Receive(out chan<- *Message) error
 	Send(msg *Message) error
+	// Drain 等待待发送消息发送完毕后以 code 关闭连接，见 Peer.Drain
+	Drain(ctx context.Context, code int, text string) error
+	// Close 关闭连接并取消所有订阅，可重复调用
+	Close() error
+	Done() <-chan struct{}
+}
+
+// serviceWorker 业务系统连接，读写与 Peer 相同
+type serviceWorker struct {
+	Peer
 }
 
 func NewServiceWorker(conn io.ReadWriter) ServiceWorker {
-	return nil
+	return &serviceWorker{Peer: NewPeer(conn, jsonCodec{}, PeerInfo{ID: genId()})}
+}
+
+func (w *serviceWorker) Info() ServiceWorkerInfo {
+	return ServiceWorkerInfo{ID: w.Peer.Info().ID}
+}
+
+func (w *serviceWorker) CloseWithCode(code int, text string) error {
+	if c, ok := w.Peer.(closeWithCoder); ok {
+		return c.CloseWithCode(code, text)
+	}
+	return w.Peer.Close()
 }
 
+// serviceNamePattern 业务系统名称用于 $.service.<name> 主题，只能是一段
+var serviceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// 与 migrations/mysql 中 comet_services 的列长度一致
+const (
+	maxServiceNameLen      = 64
+	maxServiceNamespaceLen = 255
+)
+
 type ServiceInfo struct {
-	Name string
+	Name       string
+	Namespace  string // 客户端可订阅的主题前缀，如 chat 或 app.chat，默认与 Name 相同
+	MaxPeers   int    // 客户端连接数上限，0 不限制
+	MaxWorkers int    // 业务系统连接数上限，0 不限制
+}
+
+// Validate 检查业务系统名称与主题前缀
+func (s ServiceInfo) Validate() error {
+	if !serviceNamePattern.MatchString(s.Name) {
+		return fmt.Errorf("%w: invalid name %q", errServiceInvalid, s.Name)
+	}
+	if len(s.Name) > maxServiceNameLen {
+		return fmt.Errorf("%w: name longer than %d characters", errServiceInvalid, maxServiceNameLen)
+	}
+	namespace := s.namespace()
+	if len(namespace) > maxServiceNamespaceLen {
+		return fmt.Errorf("%w: namespace longer than %d characters", errServiceInvalid, maxServiceNamespaceLen)
+	}
+	if _, err := tokenize(namespace, nil, false); err != nil {
+		return fmt.Errorf("%w: invalid namespace %q: %v", errServiceInvalid, namespace, err)
+	}
+	// 系统主题不能分配给业务系统
+	if strings.HasPrefix(namespace, "$") || strings.HasPrefix(namespace+".", InboxPrefix) {
+		return fmt.Errorf("%w: reserved namespace %q", errServiceInvalid, namespace)
+	}
+	if s.MaxPeers < 0 || s.MaxWorkers < 0 {
+		return fmt.Errorf("%w: negative limit", errServiceInvalid)
+	}
+	return nil
+}
+
+func (s ServiceInfo) namespace() string {
+	if s.Namespace == "" {
+		return s.Name
+	}
+	return s.Namespace
 }
 
 func (s ServiceInfo) Topics() (publishTopic, subscribeTopic string) {
@@ -37,64 +134,342 @@ func (s ServiceInfo) Topics() (publishTopic, subscribeTopic string) {
 	return pubTopic, subTopic
 }
 
+// EventTopic 业务系统事件主题，如 $.service.chat.slow_consumer
+func (s ServiceInfo) EventTopic(event string) string {
+	return fmt.Sprintf("$.service.%s.%s", s.Name, event)
+}
+
+// ValidatePeerTopic 检查客户端能否订阅主题，主题必须以业务系统的主题前缀开头，如 chat.user.1000
+func (s ServiceInfo) ValidatePeerTopic(topicPattern string) error {
+	tokens, err := tokenize(topicPattern, nil, true)
+	if err != nil {
+		return err
+	}
+	namespace := s.namespace()
+	prefix := split(namespace, nil)
+	if len(tokens) < len(prefix) {
+		return fmt.Errorf("%w: %q is outside namespace %q", errTopicNotAllowed, topicPattern, namespace)
+	}
+	for i, token := range prefix {
+		if tokens[i] != token {
+			return fmt.Errorf("%w: %q is outside namespace %q", errTopicNotAllowed, topicPattern, namespace)
+		}
+	}
+	return nil
+}
+
+// overlaps 两个业务系统的主题前缀是否有重叠
+func (s ServiceInfo) overlaps(other ServiceInfo) bool {
+	a, b := split(s.namespace(), nil), split(other.namespace(), nil)
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 type Service interface {
 	Info() ServiceInfo
-	Auth(token string) (ServiceIdentity, error)
+	Auth(ctx context.Context, req AuthRequest) (ServiceIdentity, error)
+	// AuthWorker 在业务系统连接升级前调用，token 不正确时返回 errWorkerUnauthorized，连接数已满时返回 errServiceFull
+	AuthWorker(token string) error
 	GetPeerTopics(peer Peer) (publishTopic, subscribeTopic string)
 
 	AddWorker(worker ServiceWorker) error
 	RemoveWorker(worker ServiceWorker)
 }
 
-func NewService() Service {
-	return nil
+// serviceDrainer 注销时需要断开业务系统连接的 Service，如 serviceImpl
+type serviceDrainer interface {
+	drain(ctx context.Context) error
+}
+
+// peerResolver 需要按 ID 查找客户端的 Service，如 serviceImpl；Comet 登记业务系统时设置查找函数
+type peerResolver interface {
+	setPeerResolver(getPeer func(id string) (Peer, bool))
+}
+
+// ServiceConfig 业务系统声明
+type ServiceConfig struct {
+	Name        string     `json:"name"`
+	Namespace   string     `json:"namespace,omitempty"` // 默认与 Name 相同
+	Auth        AuthConfig `json:"auth"`
+	PresenceURL string     `json:"presence_url,omitempty"` // 上下线回调地址，为空时不回调
+	MaxPeers    int        `json:"max_peers,omitempty"`
+	MaxWorkers  int        `json:"max_workers,omitempty"`
+}
+
+func (c ServiceConfig) Info() ServiceInfo {
+	return ServiceInfo{
+		Name:       c.Name,
+		Namespace:  c.Namespace,
+		MaxPeers:   c.MaxPeers,
+		MaxWorkers: c.MaxWorkers,
+	}
+}
+
+// clone 复制切片字段，避免调用者修改已保存的声明
+func (c ServiceConfig) clone() ServiceConfig {
+	if c.Auth.IndexedClaims != nil {
+		c.Auth.IndexedClaims = append([]string(nil), c.Auth.IndexedClaims...)
+	}
+	return c
+}
+
+// redacted 隐藏密钥，用于接口返回
+func (c ServiceConfig) redacted() ServiceConfig {
+	c = c.clone()
+	if c.Auth.Secret != "" {
+		c.Auth.Secret = "******"
+	}
+	if c.Auth.WorkerToken != "" {
+		c.Auth.WorkerToken = "******"
+	}
+	return c
+}
+
+// NewService 按声明创建业务系统，配置不合法时返回错误
+func NewService(messaging Messaging, cfg ServiceConfig) (Service, error) {
+	info := cfg.Info()
+	if err := info.Validate(); err != nil {
+		return nil, err
+	}
+	auth, err := NewAuthenticator(cfg.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errServiceInvalid, err)
+	}
+	s := &serviceImpl{
+		messaging:   messaging,
+		info:        info,
+		auth:        auth,
+		workerToken: cfg.Auth.WorkerToken,
+		servicePool: servicePool{sessions: make(map[string]ServiceWorker)},
+		workerSubs:  make(map[string][]Subscriber),
+		replies:     make(map[string]time.Time),
+	}
+	if cfg.PresenceURL != "" {
+		s.presence = NewPresenceCallback(cfg.PresenceURL)
+	}
+	return s, nil
 }
 
 type serviceImpl struct {
 	messaging   Messaging
 	info        ServiceInfo
+	auth        Authenticator
+	workerToken string            // 为空时拒绝所有业务系统连接
+	presence    *PresenceCallback // 为空时不回调上下线事件
 	servicePool servicePool
+
+	mu         sync.Mutex
+	workerSubs map[string][]Subscriber // worker 持有的订阅，移除时取消
+	getPeer    func(id string) (Peer, bool)
+	replies    map[string]time.Time // 发给 worker 的消息的回复主题及其过期时间
+	nextSweep  time.Time
 }
 
+// workerReplyTTL worker 收到消息后可以向其回复主题发布响应的时长
+const workerReplyTTL = time.Minute
+
 func (s *serviceImpl) Info() ServiceInfo {
-	//TODO implement me
-	panic("implement me")
+	return s.info
+}
+
+func (s *serviceImpl) Auth(ctx context.Context, req AuthRequest) (ServiceIdentity, error) {
+	return s.auth.Auth(ctx, req)
+}
+
+func (s *serviceImpl) AuthWorker(token string) error {
+	if s.workerToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.workerToken)) != 1 {
+		return errWorkerUnauthorized
+	}
+	if s.info.MaxWorkers > 0 && s.servicePool.CountSession() >= s.info.MaxWorkers {
+		return errServiceFull
+	}
+	return nil
 }
 
-func (s *serviceImpl) Auth(token string) (ServiceIdentity, error) {
-	//TODO implement me
-	panic("implement me")
+// NotifyPresence 回调上下线事件
+func (s *serviceImpl) NotifyPresence(e PresenceEvent) {
+	if s.presence != nil {
+		s.presence.Notify(e)
+	}
 }
 
+// peerTopicPrefix 客户端订阅 $.peer.<id>，业务系统向该主题发布消息发送给客户端
+const peerTopicPrefix = "$.peer."
+
+// GetPeerTopics 客户端消息发布到业务系统 worker 订阅的主题，客户端订阅自己的 $.peer.<id>
 func (s *serviceImpl) GetPeerTopics(peer Peer) (publishTopic, subscribeTopic string) {
-	//TODO implement me
-	panic("implement me")
+	_, subTopic := s.info.Topics()
+	return subTopic, peerTopicPrefix + peer.Info().ID
+}
+
+func (s *serviceImpl) setPeerResolver(getPeer func(id string) (Peer, bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.getPeer = getPeer
 }
 
+// workerTopic 业务系统消息发布到 topic，topic 为空时发布到 reply；只能发往本业务系统客户端的 $.peer.<id>、
+// 本业务系统 worker 收到的消息的回复主题或本业务系统命名空间内的主题，业务系统之间互不影响
+func (s *serviceImpl) workerTopic(msg *Message) (string, error) {
+	topic := msg.Topic
+	if topic == "" {
+		topic = msg.Reply
+	}
+	switch {
+	case strings.HasPrefix(topic, peerTopicPrefix):
+		if !s.ownsPeer(strings.TrimPrefix(topic, peerTopicPrefix)) {
+			return topic, fmt.Errorf("%w: %q", errTopicNotAllowed, topic)
+		}
+		return topic, nil
+	case strings.HasPrefix(topic, InboxPrefix):
+		if !s.expectsReply(topic) {
+			return topic, fmt.Errorf("%w: %q", errTopicNotAllowed, topic)
+		}
+		return topic, nil
+	}
+	return topic, s.info.ValidatePeerTopic(topic)
+}
+
+// ownsPeer 客户端是否已登记且属于本业务系统，业务系统未登记时没有客户端
+func (s *serviceImpl) ownsPeer(id string) bool {
+	s.mu.Lock()
+	getPeer := s.getPeer
+	s.mu.Unlock()
+	if getPeer == nil {
+		return false
+	}
+	peer, ok := getPeer(id)
+	return ok && peer.Info().Service == s.info.Name
+}
+
+// rememberReply 记录发给 worker 的消息的回复主题，过期的记录在之后的调用中清理
+func (s *serviceImpl) rememberReply(reply string) {
+	if !strings.HasPrefix(reply, InboxPrefix) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.After(s.nextSweep) {
+		for r, expiry := range s.replies {
+			if now.After(expiry) {
+				delete(s.replies, r)
+			}
+		}
+		s.nextSweep = now.Add(workerReplyTTL)
+	}
+	s.replies[reply] = now.Add(workerReplyTTL)
+}
+
+func (s *serviceImpl) expectsReply(reply string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiry, ok := s.replies[reply]
+	return ok && time.Now().Before(expiry)
+}
+
+// AddWorker 登记业务系统连接并转发其消息，连接断开时自动移除；失败时关闭连接
 func (s *serviceImpl) AddWorker(worker ServiceWorker) error {
-	pubTopic, subTopic := s.Info().Topics()
-	s.messaging.QueueSubscribe(subTopic, "default", func(topic string, message Message) {
-		worker.Send(&message)
-	})
+	if s.info.MaxWorkers > 0 && s.servicePool.CountSession() >= s.info.MaxWorkers {
+		closeRejected(worker, errServiceFull)
+		return errServiceFull
+	}
+	_, subTopic := s.Info().Topics()
+	var subs []Subscriber
+	// 同一用户的消息总是由同一个 worker 处理；上下线、积压事件同样按用户分配
+	topics := []string{subTopic, s.info.EventTopic(EventPresence), s.info.EventTopic(EventSlowConsumer)}
+	for _, topic := range topics {
+		subscriber, err := s.messaging.QueueSubscribe(topic, "default", func(topic string, message Message) {
+			s.rememberReply(message.Reply)
+			worker.Send(&message)
+		}, WithQueueKey(DefaultQueueKey))
+		if err != nil {
+			for _, sub := range subs {
+				sub.Unsubscribe()
+			}
+			closeRejected(worker, err)
+			return err
+		}
+		subs = append(subs, subscriber)
+	}
+	s.mu.Lock()
+	s.workerSubs[worker.Info().ID] = subs
+	s.mu.Unlock()
+	if err := s.servicePool.AddSession(worker); err != nil {
+		s.RemoveWorker(worker)
+		closeRejected(worker, err)
+		return err
+	}
+
 	go func() {
+		defer s.RemoveWorker(worker)
+
 		buf := make(chan *Message)
 		if err := worker.Receive(buf); err != nil {
+			worker.Close()
 			return
 		}
 
 		for {
 			select {
+			case <-worker.Done():
+				return
 			case msg := <-buf:
-				if err := s.messaging.Publish(pubTopic, *msg); err != nil {
-					return
+				topic, err := s.workerTopic(msg)
+				if err == nil {
+					if msg.Topic == "" {
+						msg.Topic, msg.Reply = topic, ""
+					}
+					err = s.messaging.Publish(topic, *msg)
+				}
+				if err != nil {
+					sendPeerError(worker, msg, peerTopicErrorCode(err), err.Error())
 				}
 			}
 		}
 	}()
 
-	return s.servicePool.AddSession(worker)
+	return nil
 }
 
+// RemoveWorker 移除业务系统连接并取消其订阅，可重复调用
 func (s *serviceImpl) RemoveWorker(worker ServiceWorker) {
-	s.servicePool.RemoveSession(worker.Info().ID)
+	id := worker.Info().ID
+	s.servicePool.RemoveSession(id)
+
+	s.mu.Lock()
+	subs := s.workerSubs[id]
+	delete(s.workerSubs, id)
+	s.mu.Unlock()
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+}
+
+// drain 断开所有业务系统连接并停止上下线回调
+func (s *serviceImpl) drain(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, worker := range s.servicePool.ListSession(ListPeerOption{}) {
+		wg.Add(1)
+		go func(worker ServiceWorker) {
+			defer wg.Done()
+			worker.Drain(ctx, websocket.CloseGoingAway, "service unregistered")
+			s.RemoveWorker(worker)
+		}(worker)
+	}
+	wg.Wait()
+
+	if s.presence != nil {
+		s.presence.Close()
+	}
+	return ctx.Err()
 }
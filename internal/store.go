@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ServiceStore 保存业务系统声明，启动时通过 Comet.LoadServices 恢复
+type ServiceStore interface {
+	List(ctx context.Context) ([]ServiceConfig, error)
+	// Get 不存在时返回 errServiceNotAvailable
+	Get(ctx context.Context, name string) (ServiceConfig, error)
+	// Save 按名称新增或覆盖
+	Save(ctx context.Context, cfg ServiceConfig) error
+	// Delete 不存在时返回 errServiceNotAvailable
+	Delete(ctx context.Context, name string) error
+}
+
+// memoryServiceStore 进程内的 ServiceStore，重启后丢失，用于测试或不需要持久化的部署
+type memoryServiceStore struct {
+	mu       sync.RWMutex
+	services map[string]ServiceConfig
+}
+
+func NewMemoryServiceStore() ServiceStore {
+	return &memoryServiceStore{services: make(map[string]ServiceConfig)}
+}
+
+func (s *memoryServiceStore) List(ctx context.Context) ([]ServiceConfig, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	services := make([]ServiceConfig, 0, len(s.services))
+	for _, cfg := range s.services {
+		services = append(services, cfg.clone())
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services, nil
+}
+
+func (s *memoryServiceStore) Get(ctx context.Context, name string) (ServiceConfig, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cfg, ok := s.services[name]
+	if !ok {
+		return ServiceConfig{}, fmt.Errorf("%w: %q", errServiceNotAvailable, name)
+	}
+	return cfg.clone(), nil
+}
+
+func (s *memoryServiceStore) Save(ctx context.Context, cfg ServiceConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.services[cfg.Name] = cfg.clone()
+	return nil
+}
+
+func (s *memoryServiceStore) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.services[name]; !ok {
+		return fmt.Errorf("%w: %q", errServiceNotAvailable, name)
+	}
+	delete(s.services, name)
+	return nil
+}
@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+//go:embed migrations/mysql/*.sql
+var mysqlMigrations embed.FS
+
+// mysqlMigrateLock 多个实例同时启动时只有一个执行迁移
+const mysqlMigrateLock = "comet_migrate"
+
+// migration 一个数据库迁移，文件名为 <version>_<name>.sql
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations 按版本号读取迁移文件
+func loadMigrations(fsys fs.FS, dir string) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]migration, 0, len(entries))
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: invalid version", name)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migration %s: version %d is used by %s", name, version, other)
+		}
+		seen[version] = name
+		data, err := fs.ReadFile(fsys, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(data)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// statements 按分号拆分迁移中的语句
+func (m migration) statements() []string {
+	var stmts []string
+	for _, stmt := range strings.Split(m.sql, ";") {
+		if stmt = strings.TrimSpace(stmt); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+	return stmts
+}
+
+// MySQLServiceStore 将业务系统声明保存在 MySQL 的 comet_services 表
+type MySQLServiceStore struct {
+	db *sql.DB
+}
+
+// NewMySQLServiceStore 使用已打开的连接，调用者需要先执行 Migrate
+func NewMySQLServiceStore(db *sql.DB) *MySQLServiceStore {
+	return &MySQLServiceStore{db: db}
+}
+
+// OpenMySQLServiceStore 连接 dsn 并执行迁移，dsn 格式见 github.com/go-sql-driver/mysql
+func OpenMySQLServiceStore(ctx context.Context, dsn string) (*MySQLServiceStore, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := NewMySQLServiceStore(db)
+	if err := s.Migrate(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Migrate 执行未执行过的迁移，已执行的版本记录在 comet_schema_migrations 表
+func (s *MySQLServiceStore) Migrate(ctx context.Context) error {
+	migrations, err := loadMigrations(mysqlMigrations, "migrations/mysql")
+	if err != nil {
+		return err
+	}
+
+	// 锁属于连接，加锁与解锁须使用同一连接
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 30)", mysqlMigrateLock).Scan(&locked); err != nil {
+		return err
+	}
+	if locked.Int64 != 1 {
+		return errors.New("mysql: timed out waiting for the migration lock")
+	}
+	defer conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", mysqlMigrateLock)
+
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS comet_schema_migrations (
+    version    INT          NOT NULL,
+    name       VARCHAR(255) NOT NULL,
+    applied_at DATETIME(3)  NOT NULL DEFAULT CURRENT_TIMESTAMP(3),
+    PRIMARY KEY (version)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4`); err != nil {
+		return err
+	}
+	applied := make(map[int]bool)
+	rows, err := conn.QueryContext(ctx, "SELECT version FROM comet_schema_migrations")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+		// MySQL 的 DDL 会隐式提交，迁移语句须可重复执行
+		for _, stmt := range m.statements() {
+			if _, err := conn.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("migration %s: %v", m.name, err)
+			}
+		}
+		if _, err := conn.ExecContext(ctx, "INSERT INTO comet_schema_migrations (version, name) VALUES (?, ?)", m.version, m.name); err != nil {
+			return fmt.Errorf("migration %s: %v", m.name, err)
+		}
+	}
+	return nil
+}
+
+func (s *MySQLServiceStore) Close() error {
+	return s.db.Close()
+}
+
+const mysqlServiceColumns = "name, namespace, auth, presence_url, max_peers, max_workers"
+
+func (s *MySQLServiceStore) List(ctx context.Context) ([]ServiceConfig, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT "+mysqlServiceColumns+" FROM comet_services ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var services []ServiceConfig
+	for rows.Next() {
+		cfg, err := scanServiceConfig(rows)
+		if err != nil {
+			return nil, err
+		}
+		services = append(services, cfg)
+	}
+	return services, rows.Err()
+}
+
+func (s *MySQLServiceStore) Get(ctx context.Context, name string) (ServiceConfig, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT "+mysqlServiceColumns+" FROM comet_services WHERE name = ?", name)
+	cfg, err := scanServiceConfig(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ServiceConfig{}, fmt.Errorf("%w: %q", errServiceNotAvailable, name)
+	}
+	return cfg, err
+}
+
+func (s *MySQLServiceStore) Save(ctx context.Context, cfg ServiceConfig) error {
+	auth, err := json.Marshal(cfg.Auth)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO comet_services (`+mysqlServiceColumns+`) VALUES (?, ?, ?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE namespace = VALUES(namespace), auth = VALUES(auth), presence_url = VALUES(presence_url),
+    max_peers = VALUES(max_peers), max_workers = VALUES(max_workers)`,
+		cfg.Name, cfg.Namespace, string(auth), cfg.PresenceURL, cfg.MaxPeers, cfg.MaxWorkers)
+	return err
+}
+
+func (s *MySQLServiceStore) Delete(ctx context.Context, name string) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM comet_services WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%w: %q", errServiceNotAvailable, name)
+	}
+	return nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanServiceConfig(row rowScanner) (ServiceConfig, error) {
+	var cfg ServiceConfig
+	var auth string
+	if err := row.Scan(&cfg.Name, &cfg.Namespace, &auth, &cfg.PresenceURL, &cfg.MaxPeers, &cfg.MaxWorkers); err != nil {
+		return ServiceConfig{}, err
+	}
+	if err := json.Unmarshal([]byte(auth), &cfg.Auth); err != nil {
+		return ServiceConfig{}, fmt.Errorf("service %q: invalid auth config: %v", cfg.Name, err)
+	}
+	return cfg, nil
+}
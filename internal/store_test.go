@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMemoryServiceStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryServiceStore()
+	cfg := ServiceConfig{Name: "chat", Auth: AuthConfig{Mode: AuthModeJWT, IndexedClaims: []string{"room"}}}
+	s.Save(ctx, cfg)
+	s.Save(ctx, ServiceConfig{Name: "app"})
+	cfg.Auth.IndexedClaims[0] = "changed"
+
+	got, err := s.Get(ctx, "chat")
+	if err != nil || got.Auth.IndexedClaims[0] != "room" {
+		t.Fatalf("Unexpected result %+v, %v", got, err)
+	}
+	if list, _ := s.List(ctx); len(list) != 2 || list[0].Name != "app" {
+		t.Fatalf("Unexpected list %+v", list)
+	}
+	if err := s.Delete(ctx, "chat"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := s.Get(ctx, "chat"); !errors.Is(err, errServiceNotAvailable) {
+		t.Fatalf("Expected errServiceNotAvailable, got %v", err)
+	}
+	if err := s.Delete(ctx, "chat"); !errors.Is(err, errServiceNotAvailable) {
+		t.Fatalf("Expected errServiceNotAvailable, got %v", err)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(mysqlMigrations, "migrations/mysql")
+	if err != nil || len(migrations) == 0 {
+		t.Fatalf("Unexpected result %v, %v", migrations, err)
+	}
+	for i, m := range migrations {
+		if m.version != i+1 || len(m.statements()) == 0 {
+			t.Fatalf("Unexpected migration %d: %+v", i, m)
+		}
+	}
+
+	fsys := fstest.MapFS{
+		"m/0002_b.sql": {Data: []byte("CREATE TABLE b (id INT);\nCREATE TABLE c (id INT);\n")},
+		"m/0001_a.sql": {Data: []byte("CREATE TABLE a (id INT)")},
+		"m/README.md":  {Data: []byte("ignored")},
+	}
+	migrations, err = loadMigrations(fsys, "m")
+	if err != nil || len(migrations) != 2 || migrations[0].name != "0001_a.sql" || len(migrations[1].statements()) != 2 {
+		t.Fatalf("Unexpected result %+v, %v", migrations, err)
+	}
+
+	for _, name := range []string{"m/0001_c.sql", "m/x_c.sql"} {
+		bad := fstest.MapFS{"m/0001_a.sql": {}, name: {}}
+		if _, err := loadMigrations(bad, "m"); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
+
+type failingServiceStore struct {
+	ServiceStore
+}
+
+func (s failingServiceStore) Save(ctx context.Context, cfg ServiceConfig) error {
+	return errors.New("store unavailable")
+}
+
+// hookServiceStore 保存时调用 save，用于模拟保存期间发生的事件
+type hookServiceStore struct {
+	ServiceStore
+	save func() error
+}
+
+func (s hookServiceStore) Save(ctx context.Context, cfg ServiceConfig) error {
+	return s.save()
+}
+
+func TestCometServiceStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryServiceStore()
+	cfg := ServiceConfig{Name: "news", Auth: AuthConfig{Mode: AuthModeHMAC, Secret: "secret"}}
+
+	c := NewCometWithOptions(NewStandAloneMessaging(), CometOptions{Store: store})
+	if _, err := c.CreateService(ctx, cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := c.CreateService(ctx, cfg); !errors.Is(err, errServiceExists) {
+		t.Fatalf("Expected errServiceExists, got %v", err)
+	}
+
+	// A restarted comet rebuilds its services from the store.
+	restarted := NewCometWithOptions(NewStandAloneMessaging(), CometOptions{Store: store})
+	if err := restarted.LoadServices(ctx); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := restarted.GetService("news"); !ok {
+		t.Fatalf("Expected the service to be loaded")
+	}
+
+	if err := restarted.DeleteService(ctx, "news"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if list, _ := store.List(ctx); len(list) != 0 {
+		t.Fatalf("Expected the service to be deleted, got %+v", list)
+	}
+	if err := restarted.DeleteService(ctx, "news"); !errors.Is(err, errServiceNotAvailable) {
+		t.Fatalf("Expected errServiceNotAvailable, got %v", err)
+	}
+
+	c = NewCometWithOptions(NewStandAloneMessaging(), CometOptions{Store: failingServiceStore{store}})
+	if _, err := c.CreateService(ctx, cfg); err == nil {
+		t.Fatalf("Expected an error")
+	}
+	if _, ok := c.GetService("news"); ok {
+		t.Fatalf("Expected the service to be unregistered after the store failed")
+	}
+
+	// Peers that connected while saving are disconnected gracefully even if the
+	// caller gave up in the meantime.
+	conn := &testCloseCodeConn{testFrameConn: newTestFrameConn(), code: make(chan int, 1)}
+	cctx, cancel := context.WithCancel(ctx)
+	c = NewCometWithOptions(NewStandAloneMessaging(), CometOptions{Store: hookServiceStore{store, func() error {
+		token := SignHMACToken([]byte("secret"), "1000", time.Now().Add(time.Minute))
+		peer, err := c.NewPeer(conn, PeerInfo{Service: "news", ServiceToken: token})
+		if err == nil {
+			err = c.AddPeer(peer)
+		}
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		cancel()
+		return errors.New("store unavailable")
+	}}})
+	if _, err := c.CreateService(cctx, cfg); err == nil {
+		t.Fatalf("Expected an error")
+	}
+	select {
+	case code := <-conn.code:
+		if code != websocket.CloseGoingAway {
+			t.Fatalf("Expected close code %d, got %d", websocket.CloseGoingAway, code)
+		}
+	default:
+		t.Fatalf("Expected the peer to be disconnected with a close code")
+	}
+}
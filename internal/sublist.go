@@ -3,20 +3,29 @@
 package internal
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 // A Sublist stores and efficiently retrieves subscriptions. It uses a
-// tree structure and an efficient RR cache to achieve quick lookups.
-type Sublist struct {
-	mu    sync.RWMutex
-	root  *level
-	count uint32
-	cache map[string][]interface{}
-	cmax  int
-	stats stats
+// tree structure and a bounded cache to achieve quick lookups. Stored
+// values are compared with == on removal, so T is usually a pointer.
+// Values may be grouped by queue name, see InsertQueue and MatchResult.
+type Sublist[T comparable] struct {
+	mu      sync.RWMutex
+	root    *level[T]
+	count   uint32
+	cache   matchCache[*SublistResult[T]]
+	cmax    int
+	policy  CachePolicy
+	cshards int
+	topN    int
+	stats   stats
 }
 
 type stats struct {
@@ -24,43 +33,94 @@ type stats struct {
 	removes   uint64
 	matches   uint64
 	cacheHits uint64
+	evictions uint64
 	since     time.Time
 }
 
-// A node contains subscriptions and a pointer to the next level.
-type node struct {
-	next *level
-	subs []interface{}
+// A node contains subscriptions, queue subscriptions by queue name,
+// and a pointer to the next level.
+type node[T comparable] struct {
+	next  *level[T]
+	subs  []T
+	qsubs map[string][]T
 }
 
 // A level represents a group of nodes and special pointers to
 // wildcard nodes.
-type level struct {
-	nodes    map[string]*node
-	pwc, fwc *node
+type level[T comparable] struct {
+	nodes    map[string]*node[T]
+	pwc, fwc *node[T]
 }
 
 // Create a new default node.
-func newNode() *node {
-	return &node{subs: make([]interface{}, 0, 4)}
+func newNode[T comparable]() *node[T] {
+	return &node[T]{subs: make([]T, 0, 4)}
 }
 
 // Create a new default level. We use FNV1A as the hash
 // algortihm for the tokens, which should be short.
-func newLevel() *level {
-	return &level{nodes: make(map[string]*node)}
+func newLevel[T comparable]() *level[T] {
+	return &level[T]{nodes: make(map[string]*node[T])}
 }
 
 // defaultCacheMax is used to bound limit the frontend cache
 const defaultCacheMax = 1024
 
+// defaultStatsTopN is the number of subjects reported in each of the
+// hot spot lists of Stats.
+const defaultStatsTopN = 10
+
+// maxCacheShards and minCacheShardSize are used to pick the number of cache
+// shards when it is not configured: as many as possible up to the maximum,
+// as long as each of them holds at least minCacheShardSize subjects.
+const (
+	maxCacheShards    = 16
+	minCacheShardSize = 64
+)
+
+// SublistOptions configures the match cache of a Sublist.
+type SublistOptions struct {
+	// CacheMax bounds the number of cached subjects, defaultCacheMax if zero.
+	CacheMax int
+	// CachePolicy selects the eviction policy used once CacheMax is reached.
+	CachePolicy CachePolicy
+	// CacheShards splits the cache into independently locked parts, each
+	// bounded and evicted on its own. Picked from CacheMax if zero.
+	CacheShards int
+	// StatsTopN bounds the hot spot lists of Stats, defaultStatsTopN if zero.
+	StatsTopN int
+}
+
 // NewSublist will create a default sublist
-func NewSublist() *Sublist {
-	return &Sublist{
-		root:  newLevel(),
-		cache: make(map[string][]interface{}),
-		cmax:  defaultCacheMax,
-		stats: stats{since: time.Now()},
+func NewSublist[T comparable]() *Sublist[T] {
+	return NewSublistWithOptions[T](SublistOptions{})
+}
+
+// NewSublistWithOptions will create a sublist with the given cache options.
+func NewSublistWithOptions[T comparable](opts SublistOptions) *Sublist[T] {
+	if opts.CacheMax <= 0 {
+		opts.CacheMax = defaultCacheMax
+	}
+	if opts.CacheShards <= 0 {
+		opts.CacheShards = opts.CacheMax / minCacheShardSize
+		if opts.CacheShards > maxCacheShards {
+			opts.CacheShards = maxCacheShards
+		}
+	}
+	if opts.CacheShards > opts.CacheMax {
+		opts.CacheShards = opts.CacheMax
+	}
+	if opts.StatsTopN <= 0 {
+		opts.StatsTopN = defaultStatsTopN
+	}
+	return &Sublist[T]{
+		root:    newLevel[T](),
+		cache:   newMatchCache[*SublistResult[T]](opts.CachePolicy, opts.CacheMax, opts.CacheShards),
+		cmax:    opts.CacheMax,
+		policy:  opts.CachePolicy,
+		cshards: opts.CacheShards,
+		topN:    opts.StatsTopN,
+		stats:   stats{since: time.Now()},
 	}
 }
 
@@ -71,6 +131,27 @@ var (
 	_SEP = byte('.')
 )
 
+// maxSubjectTokens bounds the depth of a subject. It also sizes the token
+// arrays kept on the stack while walking the trie.
+const maxSubjectTokens = 32
+
+// ErrInvalidSubject is matched by every SubjectError.
+var ErrInvalidSubject = errors.New("invalid subject")
+
+// SubjectError describes why a subject was rejected.
+type SubjectError struct {
+	Subject string
+	Reason  string
+}
+
+func (e *SubjectError) Error() string {
+	return fmt.Sprintf("invalid subject %q: %s", e.Subject, e.Reason)
+}
+
+func (e *SubjectError) Unwrap() error {
+	return ErrInvalidSubject
+}
+
 // split will split a subject into tokens
 func split(subject string, tokens []string) []string {
 	start := 0
@@ -83,13 +164,50 @@ func split(subject string, tokens []string) []string {
 	return append(tokens, subject[start:])
 }
 
-func (s *Sublist) Insert(subject string, sub interface{}) {
-	tsa := [16]string{}
-	toks := split(subject, tsa[:0])
+// tokenize will split a subject into tokens and validate them. Wildcard
+// tokens are only accepted when wildcards is set, and a full wildcard
+// must be the last token.
+func tokenize(subject string, tokens []string, wildcards bool) ([]string, error) {
+	tokens = split(subject, tokens)
+	if len(tokens) > maxSubjectTokens {
+		return nil, &SubjectError{subject, fmt.Sprintf("more than %d tokens", maxSubjectTokens)}
+	}
+	for i, t := range tokens {
+		switch {
+		case len(t) == 0:
+			return nil, &SubjectError{subject, "empty token"}
+		case len(t) == 1 && (t[0] == _PWC || t[0] == _FWC):
+			if !wildcards {
+				return nil, &SubjectError{subject, "wildcard in literal subject"}
+			}
+			if t[0] == _FWC && i != len(tokens)-1 {
+				return nil, &SubjectError{subject, "full wildcard is not the last token"}
+			}
+		case strings.IndexByte(t, _PWC) >= 0 || strings.IndexByte(t, _FWC) >= 0:
+			return nil, &SubjectError{subject, "wildcard inside token"}
+		}
+	}
+	return tokens, nil
+}
+
+// Insert will add sub under subject, which may contain wildcards.
+func (s *Sublist[T]) Insert(subject string, sub T) error {
+	return s.InsertQueue(subject, "", sub)
+}
+
+// InsertQueue will add sub to the queue group named queue under subject.
+// Matches return one group per queue name, holding every member stored
+// under a matching subject. An empty queue is the same as Insert.
+func (s *Sublist[T]) InsertQueue(subject, queue string, sub T) error {
+	tsa := [maxSubjectTokens]string{}
+	toks, err := tokenize(subject, tsa[:0], true)
+	if err != nil {
+		return err
+	}
 
 	s.mu.Lock()
 	l := s.root
-	var n *node
+	var n *node[T]
 
 	for _, t := range toks {
 		switch t[0] {
@@ -101,7 +219,7 @@ func (s *Sublist) Insert(subject string, sub interface{}) {
 			n = l.nodes[t]
 		}
 		if n == nil {
-			n = newNode()
+			n = newNode[T]()
 			switch t[0] {
 			case _PWC:
 				l.pwc = n
@@ -112,104 +230,114 @@ func (s *Sublist) Insert(subject string, sub interface{}) {
 			}
 		}
 		if n.next == nil {
-			n.next = newLevel()
+			n.next = newLevel[T]()
 		}
 		l = n.next
 	}
-	n.subs = append(n.subs, sub)
+	if queue == "" {
+		n.subs = append(n.subs, sub)
+	} else {
+		if n.qsubs == nil {
+			n.qsubs = make(map[string][]T)
+		}
+		n.qsubs[queue] = append(n.qsubs[queue], sub)
+	}
 	s.count++
-	s.stats.inserts++
-	s.addToCache(subject, sub)
+	atomic.AddUint64(&s.stats.inserts, 1)
+	s.addToCache(subject, queue, sub)
 	s.mu.Unlock()
+	return nil
 }
 
 // addToCache will add the new entry to existing cache
-// entries if needed.
-func (s *Sublist) addToCache(subject string, sub interface{}) {
-	if len(s.cache) == 0 {
-		return
-	}
-	for k := range s.cache {
+// entries if needed. Cached results may have been handed out by Match,
+// so they are copied rather than appended to in place.
+func (s *Sublist[T]) addToCache(subject, queue string, sub T) {
+	s.cache.refresh(func(k string, r *SublistResult[T]) (*SublistResult[T], bool) {
 		if !matchLiteral(k, subject) {
-			continue
-		}
-
-		if s.cache[k] == nil {
-			continue
+			return r, true
 		}
-		s.cache[k] = append(s.cache[k], sub)
-	}
+		return r.withAdded(queue, sub), true
+	})
 }
 
-// removeFromCache will remove the sub from any active cache entries
-func (s *Sublist) removeFromCache(subject string, sub interface{}) {
-	if len(s.cache) == 0 {
-		return
-	}
-	for k := range s.cache {
+// removeFromCache will remove one occurrence of sub from the cache entries
+// matching subject, leaving every other entry and result in place. Like
+// addToCache, it never modifies a cached result in place.
+func (s *Sublist[T]) removeFromCache(subject, queue string, sub T) {
+	s.cache.refresh(func(k string, r *SublistResult[T]) (*SublistResult[T], bool) {
 		if !matchLiteral(k, subject) {
-			continue
+			return r, true
 		}
-		delete(s.cache, k)
-		sub = s.cache[k]
-		delete(s.cache, k)
+		return r.withRemoved(queue, sub), true
+	})
+}
+
+// Match will match all entries to the literal subject, queue members
+// included. It will return a slice of results, or an error if subject is
+// not a valid literal. Without queue groups the slice is a snapshot shared
+// with the cache: it is never modified by later inserts or removes, and
+// callers must not modify it either.
+func (s *Sublist[T]) Match(subject string) ([]T, error) {
+	r, err := s.MatchResult(subject)
+	if err != nil {
+		return nil, err
 	}
+	return r.All(), nil
 }
 
-// Match will match all entries to the literal subject. It will return a
-// slice of results.
-func (s *Sublist) Match(subject string) []interface{} {
+// MatchResult will match all entries to the literal subject, keeping queue
+// members grouped by queue name. The result is a snapshot shared with the
+// cache, see SublistResult.
+func (s *Sublist[T]) MatchResult(subject string) (*SublistResult[T], error) {
 	s.mu.RLock()
 	atomic.AddUint64(&s.stats.matches, 1)
-	r := s.cache[subject]
+	r, ok := s.cache.get(subject)
 	s.mu.RUnlock()
 
-	if r != nil {
+	if ok {
 		atomic.AddUint64(&s.stats.cacheHits, 1)
-		return r
+		return r, nil
 	}
 
 	// Cache miss
 	// Process subject into tokens, this is performed
-	// unlocked, so can be parallel.
-	tsa := [32]string{}
-	toks := tsa[:0]
-
-	start := 0
-	for i := range subject {
-		if subject[i] == _SEP {
-			toks = append(toks, subject[start:i])
-			start = i + 1
-		}
+	// unlocked, so can be parallel. Only valid subjects are
+	// ever cached, so hits skip the validation.
+	tsa := [maxSubjectTokens]string{}
+	toks, err := tokenize(subject, tsa[:0], false)
+	if err != nil {
+		return nil, err
 	}
-	toks = append(toks, subject[start:])
-	results := make([]interface{}, 0, 4)
+	results := &SublistResult[T]{Subs: make([]T, 0, 4)}
 
-	// Lookup and add entry to hash.
-	s.mu.Lock()
-	matchLevel(s.root, toks, &results)
+	// Lookup and add entry to hash. Both only need the read lock: the
+	// trie is not modified, and the cache has its own locking. Writers
+	// update the cache under the write lock, so the result cannot become
+	// stale before it is stored.
+	s.mu.RLock()
+	matchLevel(s.root, toks, results)
 
-	// We use random eviction to bound the size of the cache.
-	// RR is used for speed purposes here.
-	if len(s.cache) >= s.cmax {
-		// s.cache.RemoveRandom() TODO
+	// The cache evicts according to its policy to stay within cmax.
+	results = results.seal()
+	if n := s.cache.set(subject, results); n > 0 {
+		atomic.AddUint64(&s.stats.evictions, uint64(n))
 	}
-	s.cache[string(subject)] = results
-	s.mu.Unlock()
+	s.mu.RUnlock()
 
-	return results
+	return results, nil
 }
 
 // matchLevel is used to recursively descend into the trie when there
 // is a cache miss.
-func matchLevel(l *level, toks []string, results *[]interface{}) {
-	var pwc, n *node
+func matchLevel[T comparable](l *level[T], toks []string, results *SublistResult[T]) {
+	var pwc, n *node[T]
 	for i, t := range toks {
 		if l == nil {
 			return
 		}
 		if l.fwc != nil {
-			*results = append(*results, l.fwc.subs...)
+			results.addNode(l.fwc)
 		}
 		if pwc = l.pwc; pwc != nil {
 			matchLevel(pwc.next, toks[i+1:], results)
@@ -223,38 +351,157 @@ func matchLevel(l *level, toks []string, results *[]interface{}) {
 		}
 	}
 	if n != nil {
-		*results = append(*results, n.subs...)
+		results.addNode(n)
 	}
 	if pwc != nil {
-		*results = append(*results, pwc.subs...)
+		results.addNode(pwc)
 	}
 	return
 }
 
+// MatchPattern will return every entry whose subject could match at least
+// one literal subject that pattern also matches, e.g. all subscribers that
+// would receive anything published under "chat.user.>". Unlike Match, the
+// pattern may contain wildcards and results are not cached. An entry stored
+// under several overlapping subjects is returned once per subject, queue
+// members are returned like any other entry.
+func (s *Sublist[T]) MatchPattern(pattern string) ([]T, error) {
+	tsa := [maxSubjectTokens]string{}
+	toks, err := tokenize(pattern, tsa[:0], true)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]T, 0, 4)
+
+	s.mu.RLock()
+	matchPatternLevel(s.root, toks, &results)
+	s.mu.RUnlock()
+
+	return results, nil
+}
+
+// matchPatternLevel is used to recursively descend into the trie for
+// MatchPattern. toks is never empty.
+func matchPatternLevel[T comparable](l *level[T], toks []string, results *[]T) {
+	if l == nil {
+		return
+	}
+	// A stored full wildcard overlaps with any remaining tokens.
+	if l.fwc != nil {
+		l.fwc.appendAll(results)
+	}
+
+	t, rest := toks[0], toks[1:]
+	switch {
+	case t[0] == _FWC && len(t) == 1:
+		for _, n := range l.nodes {
+			collectNode(n, results)
+		}
+		if l.pwc != nil {
+			collectNode(l.pwc, results)
+		}
+	case t[0] == _PWC && len(t) == 1:
+		for _, n := range l.nodes {
+			matchPatternNode(n, rest, results)
+		}
+		matchPatternNode(l.pwc, rest, results)
+	default:
+		matchPatternNode(l.nodes[t], rest, results)
+		matchPatternNode(l.pwc, rest, results)
+	}
+}
+
+// matchPatternNode adds the entries of n if the pattern ends here, or
+// descends to the next level otherwise.
+func matchPatternNode[T comparable](n *node[T], rest []string, results *[]T) {
+	if n == nil {
+		return
+	}
+	if len(rest) == 0 {
+		n.appendAll(results)
+		return
+	}
+	matchPatternLevel(n.next, rest, results)
+}
+
+// collectNode adds every entry stored at or below n.
+func collectNode[T comparable](n *node[T], results *[]T) {
+	n.appendAll(results)
+	if n.next == nil {
+		return
+	}
+	for _, c := range n.next.nodes {
+		collectNode(c, results)
+	}
+	if n.next.pwc != nil {
+		collectNode(n.next.pwc, results)
+	}
+	if n.next.fwc != nil {
+		collectNode(n.next.fwc, results)
+	}
+}
+
+// Intersects reports whether two subjects, wildcards allowed, match at
+// least one common literal subject. Invalid subjects never intersect.
+func Intersects(patternA, patternB string) bool {
+	tsa, tsb := [maxSubjectTokens]string{}, [maxSubjectTokens]string{}
+	a, err := tokenize(patternA, tsa[:0], true)
+	if err != nil {
+		return false
+	}
+	b, err := tokenize(patternB, tsb[:0], true)
+	if err != nil {
+		return false
+	}
+
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ta, tb := a[i], b[i]
+		switch {
+		case ta[0] == _FWC && len(ta) == 1, tb[0] == _FWC && len(tb) == 1:
+			return true
+		case ta[0] == _PWC && len(ta) == 1, tb[0] == _PWC && len(tb) == 1:
+			continue
+		case ta != tb:
+			return false
+		}
+	}
+	return len(a) == len(b)
+}
+
 // lnt is used to track descent into a removal for pruning.
-type lnt struct {
-	l *level
-	n *node
+type lnt[T comparable] struct {
+	l *level[T]
+	n *node[T]
 	t string
 }
 
 // Remove will remove any item associated with key. It will track descent
-// into the trie and prune upon successful removal.
-func (s *Sublist) Remove(subject string, sub interface{}) {
-	tsa := [16]string{}
-	toks := split(subject, tsa[:0])
+// into the trie and prune upon successful removal. Removing an item that
+// is not stored is not an error.
+func (s *Sublist[T]) Remove(subject string, sub T) error {
+	return s.RemoveQueue(subject, "", sub)
+}
+
+// RemoveQueue will remove sub from the queue group named queue under
+// subject, as inserted with InsertQueue.
+func (s *Sublist[T]) RemoveQueue(subject, queue string, sub T) error {
+	tsa := [maxSubjectTokens]string{}
+	toks, err := tokenize(subject, tsa[:0], true)
+	if err != nil {
+		return err
+	}
 
 	s.mu.Lock()
 	l := s.root
-	var n *node
+	var n *node[T]
 
-	var lnts [32]lnt
+	var lnts [maxSubjectTokens]lnt[T]
 	levels := lnts[:0]
 
 	for _, t := range toks {
 		if l == nil {
 			s.mu.Unlock()
-			return
+			return nil
 		}
 		switch t[0] {
 		case _PWC:
@@ -265,19 +512,19 @@ func (s *Sublist) Remove(subject string, sub interface{}) {
 			n = l.nodes[string(t)]
 		}
 		if n != nil {
-			levels = append(levels, lnt{l, n, t})
+			levels = append(levels, lnt[T]{l, n, t})
 			l = n.next
 		} else {
 			l = nil
 		}
 	}
-	if !s.removeFromNode(n, sub) {
+	if !s.removeFromNode(n, queue, sub) {
 		s.mu.Unlock()
-		return
+		return nil
 	}
 
 	s.count--
-	s.stats.removes++
+	atomic.AddUint64(&s.stats.removes, 1)
 
 	for i := len(levels) - 1; i >= 0; i-- {
 		l, n, t := levels[i].l, levels[i].n, levels[i].t
@@ -285,12 +532,13 @@ func (s *Sublist) Remove(subject string, sub interface{}) {
 			l.pruneNode(n, t)
 		}
 	}
-	s.removeFromCache(subject, sub)
+	s.removeFromCache(subject, queue, sub)
 	s.mu.Unlock()
+	return nil
 }
 
 // pruneNode is used to prune and empty node from the tree.
-func (l *level) pruneNode(n *node, t string) {
+func (l *level[T]) pruneNode(n *node[T], t string) {
 	if n == nil {
 		return
 	}
@@ -305,8 +553,8 @@ func (l *level) pruneNode(n *node, t string) {
 
 // isEmpty will test if the node has any entries. Used
 // in pruning.
-func (n *node) isEmpty() bool {
-	if len(n.subs) == 0 {
+func (n *node[T]) isEmpty() bool {
+	if len(n.subs) == 0 && len(n.qsubs) == 0 {
 		if n.next == nil || n.next.numNodes() == 0 {
 			return true
 		}
@@ -315,7 +563,7 @@ func (n *node) isEmpty() bool {
 }
 
 // Return the number of nodes for the given level.
-func (l *level) numNodes() uint32 {
+func (l *level[T]) numNodes() uint32 {
 	num := len(l.nodes)
 	if l.pwc != nil {
 		num += 1
@@ -326,21 +574,48 @@ func (l *level) numNodes() uint32 {
 	return uint32(num)
 }
 
+// appendAll adds the subs and queue subs of the node to results.
+func (n *node[T]) appendAll(results *[]T) {
+	*results = append(*results, n.subs...)
+	for _, qsubs := range n.qsubs {
+		*results = append(*results, qsubs...)
+	}
+}
+
 // Remove the sub for the given node.
-func (s *Sublist) removeFromNode(n *node, sub interface{}) bool {
+func (s *Sublist[T]) removeFromNode(n *node[T], queue string, sub T) bool {
 	if n == nil {
 		return false
 	}
-	for i, v := range n.subs {
+	if queue != "" {
+		qsubs, ok := removeFromSlice(n.qsubs[queue], sub)
+		if !ok {
+			return false
+		}
+		if len(qsubs) == 0 {
+			delete(n.qsubs, queue)
+		} else {
+			n.qsubs[queue] = qsubs
+		}
+		return true
+	}
+	var ok bool
+	n.subs, ok = removeFromSlice(n.subs, sub)
+	return ok
+}
+
+// removeFromSlice removes the first occurrence of sub in place.
+func removeFromSlice[T comparable](a []T, sub T) ([]T, bool) {
+	for i, v := range a {
 		if v == sub {
-			num := len(n.subs)
-			a := n.subs
+			num := len(a)
 			copy(a[i:num-1], a[i+1:num])
-			n.subs = a[0 : num-1]
-			return true
+			var zero T
+			a[num-1] = zero
+			return a[0 : num-1], true
 		}
 	}
-	return false
+	return a, false
 }
 
 // matchLiteral is used to test literal subjects, those that do not have any
@@ -375,8 +650,121 @@ func matchLiteral(literal, subject string) bool {
 	return true
 }
 
+// Walk will call fn for every stored entry, in subject order with literal
+// tokens before wildcards, until fn returns false. The Sublist is read
+// locked during the walk, so fn must not modify it.
+func (s *Sublist[T]) Walk(fn func(subject string, sub T) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tsa := [maxSubjectTokens]string{}
+	walkLevel(s.root, tsa[:0], func(subject, _ string, sub T) bool {
+		return fn(subject, sub)
+	})
+}
+
+// walkLevel is used to recursively descend into the trie for Walk. It
+// returns false once fn asked to stop.
+func walkLevel[T comparable](l *level[T], toks []string, fn func(subject, queue string, sub T) bool) bool {
+	if l == nil {
+		return true
+	}
+	keys := make([]string, 0, len(l.nodes))
+	for k := range l.nodes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !walkNode(l.nodes[k], append(toks, k), fn) {
+			return false
+		}
+	}
+	if l.pwc != nil && !walkNode(l.pwc, append(toks, string(_PWC)), fn) {
+		return false
+	}
+	if l.fwc != nil && !walkNode(l.fwc, append(toks, string(_FWC)), fn) {
+		return false
+	}
+	return true
+}
+
+// walkNode visits the subs of n, then its queue subs in queue name order.
+func walkNode[T comparable](n *node[T], toks []string, fn func(subject, queue string, sub T) bool) bool {
+	if len(n.subs) > 0 || len(n.qsubs) > 0 {
+		subject := strings.Join(toks, string(_SEP))
+		for _, sub := range n.subs {
+			if !fn(subject, "", sub) {
+				return false
+			}
+		}
+		queues := make([]string, 0, len(n.qsubs))
+		for queue := range n.qsubs {
+			queues = append(queues, queue)
+		}
+		sort.Strings(queues)
+		for _, queue := range queues {
+			for _, sub := range n.qsubs[queue] {
+				if !fn(subject, queue, sub) {
+					return false
+				}
+			}
+		}
+	}
+	return walkLevel(n.next, toks, fn)
+}
+
+// SublistEntry is a subject and one of the values stored under it.
+type SublistEntry[T comparable] struct {
+	Subject string `json:"subject"`
+	Queue   string `json:"queue,omitempty"`
+	Value   T      `json:"value"`
+}
+
+// Snapshot will return every stored entry in Walk order. The result can be
+// serialized, e.g. as JSON, as long as T can.
+func (s *Sublist[T]) Snapshot() []SublistEntry[T] {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := make([]SublistEntry[T], 0, s.count)
+	tsa := [maxSubjectTokens]string{}
+	walkLevel(s.root, tsa[:0], func(subject, queue string, sub T) bool {
+		entries = append(entries, SublistEntry[T]{Subject: subject, Queue: queue, Value: sub})
+		return true
+	})
+	return entries
+}
+
+// Restore will replace the content of the Sublist with entries, typically
+// taken from Snapshot. The cache is dropped. Nothing is replaced if any of
+// the subjects is invalid.
+func (s *Sublist[T]) Restore(entries []SublistEntry[T]) error {
+	r := NewSublistWithOptions[T](SublistOptions{
+		CacheMax:    s.cmax,
+		CachePolicy: s.policy,
+		CacheShards: s.cshards,
+		StatsTopN:   s.topN,
+	})
+	for _, e := range entries {
+		if err := r.InsertQueue(e.Subject, e.Queue, e.Value); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.root = r.root
+	s.count = r.count
+	s.cache = r.cache
+	s.mu.Unlock()
+	return nil
+}
+
 // Count return the number of stored items in the HashMap.
-func (s *Sublist) Count() uint32 { return s.count }
+func (s *Sublist[T]) Count() uint32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.count
+}
 
 // Stats for the sublist
 type Stats struct {
@@ -385,57 +773,119 @@ type Stats struct {
 	NumInserts   uint64
 	NumRemoves   uint64
 	NumMatches   uint64
+	NumEvictions uint64
+	CacheMax     uint32
+	CachePolicy  CachePolicy
+	CacheShards  uint32
 	CacheHitRate float64
 	MaxFanout    uint32
 	AvgFanout    float64
-	StatsTime    time.Time
+	// HotSubjects lists the cached subjects with the most matches, and
+	// TopFanout those with the most results, both in descending order.
+	// Counts start when a subject is cached and are lost on eviction.
+	HotSubjects []SubjectStats
+	TopFanout   []SubjectStats
+	StatsTime   time.Time
+}
+
+// SubjectStats for a single cached subject
+type SubjectStats struct {
+	Subject string
+	Matches uint64
+	Fanout  uint32
 }
 
 // Stats will return a stats structure for the current state.
-func (s *Sublist) Stats() *Stats {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *Sublist[T]) Stats() *Stats {
+	// The read lock keeps the trie and cache consistent with each other,
+	// counters are updated atomically by concurrent matchers.
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
 	st := &Stats{}
 	st.NumSubs = s.count
-	st.NumCache = uint32(len(s.cache))
-	st.NumInserts = s.stats.inserts
-	st.NumRemoves = s.stats.removes
-	st.NumMatches = s.stats.matches
-	if s.stats.matches > 0 {
-		st.CacheHitRate = float64(s.stats.cacheHits) / float64(s.stats.matches)
-	}
-	// whip through cache for fanout stats
-	// FIXME, creating all each time could be expensive, should do a cb version.
-	tot, max := 0, 0
-	for _, r := range s.cache {
-		l := len(r)
+	st.NumCache = uint32(s.cache.len())
+	st.NumInserts = atomic.LoadUint64(&s.stats.inserts)
+	st.NumRemoves = atomic.LoadUint64(&s.stats.removes)
+	st.NumMatches = atomic.LoadUint64(&s.stats.matches)
+	st.NumEvictions = atomic.LoadUint64(&s.stats.evictions)
+	st.CacheMax = uint32(s.cmax)
+	st.CachePolicy = s.policy
+	st.CacheShards = uint32(s.cshards)
+	if st.NumMatches > 0 {
+		st.CacheHitRate = float64(atomic.LoadUint64(&s.stats.cacheHits)) / float64(st.NumMatches)
+	}
+	// whip through cache for fanout and hot spot stats
+	tot, max, num := 0, 0, 0
+	hot := make([]SubjectStats, 0, s.topN)
+	fanout := make([]SubjectStats, 0, s.topN)
+	s.cache.stats(func(subject string, r *SublistResult[T], matches uint64) {
+		l := r.Fanout()
 		tot += l
 		if l > max {
 			max = l
 		}
-	}
+		num++
+
+		ss := SubjectStats{Subject: subject, Matches: matches, Fanout: uint32(l)}
+		hot = insertTopN(hot, ss, s.topN, func(a, b SubjectStats) bool {
+			return a.Matches > b.Matches
+		})
+		fanout = insertTopN(fanout, ss, s.topN, func(a, b SubjectStats) bool {
+			return a.Fanout > b.Fanout
+		})
+	})
 	st.MaxFanout = uint32(max)
-	st.AvgFanout = float64(tot) / float64(len(s.cache))
+	if num > 0 {
+		st.AvgFanout = float64(tot) / float64(num)
+	}
+	st.HotSubjects = hot
+	st.TopFanout = fanout
 	st.StatsTime = s.stats.since
 	return st
 }
 
+// insertTopN inserts ss into top, kept sorted with before and no longer
+// than n. Ties keep the earlier entry first.
+func insertTopN(top []SubjectStats, ss SubjectStats, n int, before func(a, b SubjectStats) bool) []SubjectStats {
+	i := len(top)
+	for i > 0 && before(ss, top[i-1]) {
+		i--
+	}
+	if i >= n {
+		return top
+	}
+	if len(top) < n {
+		top = append(top, SubjectStats{})
+	}
+	copy(top[i+1:], top[i:])
+	top[i] = ss
+	return top
+}
+
 // ResetStats will clear stats and update StatsTime to time.Now()
-func (s *Sublist) ResetStats() {
-	s.stats = stats{}
+func (s *Sublist[T]) ResetStats() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	atomic.StoreUint64(&s.stats.inserts, 0)
+	atomic.StoreUint64(&s.stats.removes, 0)
+	atomic.StoreUint64(&s.stats.matches, 0)
+	atomic.StoreUint64(&s.stats.cacheHits, 0)
+	atomic.StoreUint64(&s.stats.evictions, 0)
 	s.stats.since = time.Now()
+	s.cache.resetStats()
 }
 
 // numLevels will return the maximum number of levels
 // contained in the Sublist tree.
-func (s *Sublist) numLevels() int {
+func (s *Sublist[T]) numLevels() int {
 	return visitLevel(s.root, 0)
 }
 
 // visitLevel is used to descend the Sublist tree structure
 // recursively.
-func visitLevel(l *level, depth int) int {
+func visitLevel[T comparable](l *level[T], depth int) int {
 	if l == nil || l.numNodes() == 0 {
 		return depth
 	}
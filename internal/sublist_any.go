@@ -0,0 +1,96 @@
+package internal
+
+import "sync"
+
+// AnySublist adapts Sublist to the untyped API it had before it was made
+// generic. Values must be comparable at runtime since they are used as map
+// keys, exactly as they were compared with == before.
+type AnySublist struct {
+	sl *Sublist[*anyRef]
+
+	mu   sync.Mutex
+	refs map[interface{}]*anyRef
+}
+
+// anyRef is the stable, comparable handle stored for an untyped value.
+type anyRef struct {
+	v    interface{}
+	uses int
+}
+
+// NewAnySublist will create a default untyped sublist
+func NewAnySublist() *AnySublist {
+	return NewAnySublistWithOptions(SublistOptions{})
+}
+
+// NewAnySublistWithOptions will create an untyped sublist with the given
+// cache options.
+func NewAnySublistWithOptions(opts SublistOptions) *AnySublist {
+	return &AnySublist{
+		sl:   NewSublistWithOptions[*anyRef](opts),
+		refs: make(map[interface{}]*anyRef),
+	}
+}
+
+// Insert will add sub under subject.
+func (s *AnySublist) Insert(subject string, sub interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ref, ok := s.refs[sub]
+	if !ok {
+		ref = &anyRef{v: sub}
+	}
+	if err := s.sl.Insert(subject, ref); err != nil {
+		return err
+	}
+	s.refs[sub] = ref
+	ref.uses++
+	return nil
+}
+
+// Remove will remove sub from subject.
+func (s *AnySublist) Remove(subject string, sub interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ref, ok := s.refs[sub]
+	if !ok {
+		_, err := tokenize(subject, nil, true)
+		return err
+	}
+	// Only the adapter mutates sl, so the count tells whether ref was found.
+	before := s.sl.Count()
+	if err := s.sl.Remove(subject, ref); err != nil {
+		return err
+	}
+	if s.sl.Count() < before {
+		ref.uses--
+		if ref.uses == 0 {
+			delete(s.refs, sub)
+		}
+	}
+	return nil
+}
+
+// Match will match all entries to the literal subject.
+func (s *AnySublist) Match(subject string) ([]interface{}, error) {
+	refs, err := s.sl.Match(subject)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]interface{}, len(refs))
+	for i, ref := range refs {
+		results[i] = ref.v
+	}
+	return results, nil
+}
+
+// Count return the number of stored items.
+func (s *AnySublist) Count() uint32 { return s.sl.Count() }
+
+// Stats will return a stats structure for the current state.
+func (s *AnySublist) Stats() *Stats { return s.sl.Stats() }
+
+// ResetStats will clear stats and update StatsTime to time.Now()
+func (s *AnySublist) ResetStats() { s.sl.ResetStats() }
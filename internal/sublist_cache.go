@@ -0,0 +1,336 @@
+package internal
+
+import (
+	"container/list"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// CachePolicy selects how the Sublist match cache picks an entry to evict
+// once it reaches its capacity.
+type CachePolicy int
+
+const (
+	// CacheRandom evicts a random entry. This is the cheapest policy and
+	// works well when the subject space is large and uniformly accessed.
+	CacheRandom CachePolicy = iota
+	// CacheLRU evicts the least recently matched entry.
+	CacheLRU
+)
+
+func (p CachePolicy) String() string {
+	switch p {
+	case CacheRandom:
+		return "random"
+	case CacheLRU:
+		return "lru"
+	default:
+		return "unknown"
+	}
+}
+
+// matchCache caches match results of type R by literal subject. Implementations are
+// safe for concurrent use and never hold more than their capacity. Each
+// entry counts the matches it served, starting with the one that set it.
+type matchCache[R any] interface {
+	// get returns the cached result for subject and counts a match.
+	get(subject string) (R, bool)
+	// set stores the result for subject and reports how many entries were
+	// evicted to make room for it. Replacing a result keeps its count.
+	set(subject string, r R) int
+	// refresh calls fn for every cached entry. The entry is replaced by the
+	// returned result, or dropped when fn returns false. It does not count as
+	// an access for eviction purposes.
+	refresh(fn func(subject string, r R) (R, bool))
+	// len returns the number of cached entries.
+	len() int
+	// stats calls fn for every cached entry with its match count.
+	stats(fn func(subject string, r R, matches uint64))
+	// resetStats sets every match count back to zero.
+	resetStats()
+}
+
+func newMatchCache[R any](policy CachePolicy, max int, shards int) matchCache[R] {
+	if shards > 1 {
+		return newShardedCache[R](policy, max, shards)
+	}
+	switch policy {
+	case CacheLRU:
+		return newLRUCache[R](max)
+	default:
+		return newRandomCache[R](max)
+	}
+}
+
+// shardedCache spreads subjects over independently locked caches so that
+// concurrent matchers on distinct subjects rarely contend. Eviction is done
+// per shard, each holding an equal part of the capacity; the remainder goes to
+// the first shards so that the shards together hold exactly max subjects.
+type shardedCache[R any] struct {
+	shards []matchCache[R]
+}
+
+func newShardedCache[R any](policy CachePolicy, max int, shards int) *shardedCache[R] {
+	c := &shardedCache[R]{shards: make([]matchCache[R], shards)}
+	for i := range c.shards {
+		n := max / shards
+		if i < max%shards {
+			n++
+		}
+		c.shards[i] = newMatchCache[R](policy, n, 1)
+	}
+	return c
+}
+
+// shard picks the cache for subject using FNV-1a.
+func (c *shardedCache[R]) shard(subject string) matchCache[R] {
+	h := uint32(2166136261)
+	for i := 0; i < len(subject); i++ {
+		h ^= uint32(subject[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
+}
+
+func (c *shardedCache[R]) get(subject string) (R, bool) {
+	return c.shard(subject).get(subject)
+}
+
+func (c *shardedCache[R]) set(subject string, r R) int {
+	return c.shard(subject).set(subject, r)
+}
+
+func (c *shardedCache[R]) refresh(fn func(subject string, r R) (R, bool)) {
+	for _, shard := range c.shards {
+		shard.refresh(fn)
+	}
+}
+
+func (c *shardedCache[R]) len() int {
+	n := 0
+	for _, shard := range c.shards {
+		n += shard.len()
+	}
+	return n
+}
+
+func (c *shardedCache[R]) stats(fn func(subject string, r R, matches uint64)) {
+	for _, shard := range c.shards {
+		shard.stats(fn)
+	}
+}
+
+func (c *shardedCache[R]) resetStats() {
+	for _, shard := range c.shards {
+		shard.resetStats()
+	}
+}
+
+// randomCache implements random replacement. Keys are also kept in a slice
+// so a victim can be picked uniformly in constant time.
+type randomCache[R any] struct {
+	mu      sync.RWMutex
+	max     int
+	entries map[string]*randomEntry[R]
+	keys    []string
+}
+
+type randomEntry[R any] struct {
+	matches uint64 // updated atomically, as get only holds the read lock
+	idx     int
+	r       R
+}
+
+func newRandomCache[R any](max int) *randomCache[R] {
+	return &randomCache[R]{
+		max:     max,
+		entries: make(map[string]*randomEntry[R]),
+	}
+}
+
+func (c *randomCache[R]) get(subject string) (R, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	e, ok := c.entries[subject]
+	if !ok {
+		var zero R
+		return zero, false
+	}
+	atomic.AddUint64(&e.matches, 1)
+	return e.r, true
+}
+
+func (c *randomCache[R]) set(subject string, r R) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[subject]; ok {
+		e.r = r
+		return 0
+	}
+	evicted := 0
+	for len(c.keys) >= c.max && len(c.keys) > 0 {
+		c.removeAt(rand.Intn(len(c.keys)))
+		evicted++
+	}
+	c.entries[subject] = &randomEntry[R]{matches: 1, idx: len(c.keys), r: r}
+	c.keys = append(c.keys, subject)
+	return evicted
+}
+
+func (c *randomCache[R]) refresh(fn func(subject string, r R) (R, bool)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Walk backwards so removals, which swap in the last key, do not skip
+	// entries that have not been visited yet.
+	for i := len(c.keys) - 1; i >= 0; i-- {
+		k := c.keys[i]
+		e := c.entries[k]
+		r, keep := fn(k, e.r)
+		if !keep {
+			c.removeAt(i)
+			continue
+		}
+		e.r = r
+	}
+}
+
+func (c *randomCache[R]) len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.keys)
+}
+
+func (c *randomCache[R]) stats(fn func(subject string, r R, matches uint64)) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, k := range c.keys {
+		e := c.entries[k]
+		fn(k, e.r, atomic.LoadUint64(&e.matches))
+	}
+}
+
+func (c *randomCache[R]) resetStats() {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, e := range c.entries {
+		atomic.StoreUint64(&e.matches, 0)
+	}
+}
+
+// removeAt removes the key at index i by swapping in the last key.
+func (c *randomCache[R]) removeAt(i int) {
+	last := len(c.keys) - 1
+	delete(c.entries, c.keys[i])
+	if i != last {
+		c.keys[i] = c.keys[last]
+		c.entries[c.keys[i]].idx = i
+	}
+	c.keys[last] = ""
+	c.keys = c.keys[:last]
+}
+
+// lruCache evicts the least recently matched subject.
+type lruCache[R any] struct {
+	mu      sync.Mutex
+	max     int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type lruEntry[R any] struct {
+	subject string
+	matches uint64
+	r       R
+}
+
+func newLRUCache[R any](max int) *lruCache[R] {
+	return &lruCache[R]{
+		max:     max,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (c *lruCache[R]) get(subject string) (R, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[subject]
+	if !ok {
+		var zero R
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	e := el.Value.(*lruEntry[R])
+	e.matches++
+	return e.r, true
+}
+
+func (c *lruCache[R]) set(subject string, r R) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[subject]; ok {
+		el.Value.(*lruEntry[R]).r = r
+		c.order.MoveToFront(el)
+		return 0
+	}
+	evicted := 0
+	for c.order.Len() >= c.max && c.order.Len() > 0 {
+		el := c.order.Back()
+		c.order.Remove(el)
+		delete(c.entries, el.Value.(*lruEntry[R]).subject)
+		evicted++
+	}
+	c.entries[subject] = c.order.PushFront(&lruEntry[R]{subject: subject, matches: 1, r: r})
+	return evicted
+}
+
+func (c *lruCache[R]) refresh(fn func(subject string, r R) (R, bool)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+		e := el.Value.(*lruEntry[R])
+		r, keep := fn(e.subject, e.r)
+		if keep {
+			e.r = r
+		} else {
+			c.order.Remove(el)
+			delete(c.entries, e.subject)
+		}
+		el = next
+	}
+}
+
+func (c *lruCache[R]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *lruCache[R]) stats(fn func(subject string, r R, matches uint64)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*lruEntry[R])
+		fn(e.subject, e.r, e.matches)
+	}
+}
+
+func (c *lruCache[R]) resetStats() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		el.Value.(*lruEntry[R]).matches = 0
+	}
+}
@@ -0,0 +1,162 @@
+package internal
+
+import "sort"
+
+// A SublistResult is the outcome of a match: plain entries, each of which
+// should receive a message, and queue groups, of which only one member
+// should. Results are shared with the cache, so they are never modified
+// once returned and callers must not modify them either.
+type SublistResult[T comparable] struct {
+	Subs   []T
+	Queues []QueueGroup[T] // sorted by name
+}
+
+// A QueueGroup holds the entries inserted with the same queue name.
+type QueueGroup[T comparable] struct {
+	Name    string
+	Members []T
+}
+
+// Len returns the number of entries, queue members included.
+func (r *SublistResult[T]) Len() int {
+	n := len(r.Subs)
+	for _, g := range r.Queues {
+		n += len(g.Members)
+	}
+	return n
+}
+
+// Fanout returns the number of deliveries for a message matching the
+// result: one per plain entry and one per queue group.
+func (r *SublistResult[T]) Fanout() int {
+	return len(r.Subs) + len(r.Queues)
+}
+
+// All returns every entry, plain entries first and then queue members in
+// queue name order. Without queue groups this does not allocate.
+func (r *SublistResult[T]) All() []T {
+	if len(r.Queues) == 0 {
+		return r.Subs
+	}
+	all := make([]T, 0, r.Len())
+	all = append(all, r.Subs...)
+	for _, g := range r.Queues {
+		all = append(all, g.Members...)
+	}
+	return all
+}
+
+// queueIndex returns the position of the queue group named queue, or where
+// it would be inserted, and whether it exists.
+func (r *SublistResult[T]) queueIndex(queue string) (int, bool) {
+	i := sort.Search(len(r.Queues), func(i int) bool {
+		return r.Queues[i].Name >= queue
+	})
+	return i, i < len(r.Queues) && r.Queues[i].Name == queue
+}
+
+// addNode appends the entries stored in n while building a result on a
+// cache miss. The result must be sealed once complete.
+func (r *SublistResult[T]) addNode(n *node[T]) {
+	r.Subs = append(r.Subs, n.subs...)
+	for name, qsubs := range n.qsubs {
+		i := 0
+		for ; i < len(r.Queues); i++ {
+			if r.Queues[i].Name == name {
+				break
+			}
+		}
+		if i == len(r.Queues) {
+			r.Queues = append(r.Queues, QueueGroup[T]{Name: name})
+		}
+		r.Queues[i].Members = append(r.Queues[i].Members, qsubs...)
+	}
+}
+
+// seal sorts the queue groups and clips every capacity, so that appends by
+// callers never share an array with the cache.
+func (r *SublistResult[T]) seal() *SublistResult[T] {
+	sort.Slice(r.Queues, func(i, j int) bool {
+		return r.Queues[i].Name < r.Queues[j].Name
+	})
+	for i := range r.Queues {
+		r.Queues[i].Members = r.Queues[i].Members[:len(r.Queues[i].Members):len(r.Queues[i].Members)]
+	}
+	r.Subs = r.Subs[:len(r.Subs):len(r.Subs)]
+	r.Queues = r.Queues[:len(r.Queues):len(r.Queues)]
+	return r
+}
+
+// withAdded returns a copy of r with sub added to queue, or to the plain
+// entries if queue is empty. r itself is left untouched.
+func (r *SublistResult[T]) withAdded(queue string, sub T) *SublistResult[T] {
+	nr := &SublistResult[T]{Subs: r.Subs, Queues: r.Queues}
+	if queue == "" {
+		nr.Subs = appendCopy(r.Subs, sub)
+		return nr
+	}
+
+	i, ok := r.queueIndex(queue)
+	nr.Queues = make([]QueueGroup[T], len(r.Queues), len(r.Queues)+1)
+	copy(nr.Queues, r.Queues)
+	if ok {
+		nr.Queues[i].Members = appendCopy(r.Queues[i].Members, sub)
+		return nr
+	}
+	nr.Queues = append(nr.Queues, QueueGroup[T]{})
+	copy(nr.Queues[i+1:], nr.Queues[i:])
+	nr.Queues[i] = QueueGroup[T]{Name: queue, Members: []T{sub}}
+	return nr
+}
+
+// withRemoved returns a copy of r without one occurrence of sub in queue,
+// dropping the group once empty. r is returned as is if sub is not found.
+func (r *SublistResult[T]) withRemoved(queue string, sub T) *SublistResult[T] {
+	if queue == "" {
+		subs, ok := removeCopy(r.Subs, sub)
+		if !ok {
+			return r
+		}
+		return &SublistResult[T]{Subs: subs, Queues: r.Queues}
+	}
+
+	i, ok := r.queueIndex(queue)
+	if !ok {
+		return r
+	}
+	members, ok := removeCopy(r.Queues[i].Members, sub)
+	if !ok {
+		return r
+	}
+	nr := &SublistResult[T]{Subs: r.Subs}
+	if len(members) == 0 {
+		nr.Queues = make([]QueueGroup[T], 0, len(r.Queues)-1)
+		nr.Queues = append(nr.Queues, r.Queues[:i]...)
+		nr.Queues = append(nr.Queues, r.Queues[i+1:]...)
+		return nr
+	}
+	nr.Queues = make([]QueueGroup[T], len(r.Queues))
+	copy(nr.Queues, r.Queues)
+	nr.Queues[i].Members = members
+	return nr
+}
+
+// appendCopy returns a new slice holding s followed by v.
+func appendCopy[T comparable](s []T, v T) []T {
+	ns := make([]T, len(s), len(s)+1)
+	copy(ns, s)
+	return append(ns, v)
+}
+
+// removeCopy returns a new slice holding s without its first occurrence of
+// v, and whether v was found.
+func removeCopy[T comparable](s []T, v T) ([]T, bool) {
+	for i := range s {
+		if s[i] == v {
+			ns := make([]T, 0, len(s)-1)
+			ns = append(ns, s[:i]...)
+			return append(ns, s[i+1:]...), true
+		}
+	}
+	return s, false
+}
@@ -1,39 +1,49 @@
 package internal
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-func verifyCount(s *Sublist, count uint32, t *testing.T) {
+func verifyCount[T comparable](s *Sublist[T], count uint32, t *testing.T) {
 	if s.Count() != count {
 		t.Errorf("Count is %d, should be %d", s.Count(), count)
 	}
 }
 
-func verifyLen(r []interface{}, l int, t *testing.T) {
+func verifyLen[T any](r []T, l int, t *testing.T) {
 	if len(r) != l {
 		t.Errorf("Results len is %d, should be %d", len(r), l)
 	}
 }
 
-func verifyMember(r []interface{}, val string, t *testing.T) {
+func verifyMember[T comparable](r []T, val T, t *testing.T) {
 	for _, v := range r {
-		if v == nil {
-			continue
+		if v == val {
+			return
 		}
-		if v.(string) == val {
+	}
+	t.Errorf("Value '%v' not found in results", val)
+}
+
+func verifyAnyMember(r []interface{}, val interface{}, t *testing.T) {
+	for _, v := range r {
+		if v == val {
 			return
 		}
 	}
-	t.Errorf("Value '%s' not found in results", val)
+	t.Errorf("Value '%v' not found in results", val)
 }
 
-func verifyNumLevels(s *Sublist, expected int, t *testing.T) {
+func verifyNumLevels[T comparable](s *Sublist[T], expected int, t *testing.T) {
 	dl := s.numLevels()
 	if dl != expected {
 		t.Errorf("NumLevels is %d, should be %d", dl, expected)
@@ -41,12 +51,12 @@ func verifyNumLevels(s *Sublist, expected int, t *testing.T) {
 }
 
 func TestInit(t *testing.T) {
-	s := NewSublist()
+	s := NewSublist[string]()
 	verifyCount(s, 0, t)
 }
 
 func TestInsertCount(t *testing.T) {
-	s := NewSublist()
+	s := NewSublist[string]()
 	s.Insert("foo", "a")
 	s.Insert("bar", "b")
 	s.Insert("foo.bar", "b")
@@ -54,66 +64,66 @@ func TestInsertCount(t *testing.T) {
 }
 
 func TestSimple(t *testing.T) {
-	s := NewSublist()
+	s := NewSublist[string]()
 	val := "a"
 	sub := "foo"
 	s.Insert(sub, val)
-	r := s.Match(sub)
+	r, _ := s.Match(sub)
 	verifyLen(r, 1, t)
 	verifyMember(r, val, t)
 }
 
 func TestSimpleMultiTokens(t *testing.T) {
-	s := NewSublist()
+	s := NewSublist[string]()
 	val := "a"
 	sub := "foo.bar.baz"
 	s.Insert(sub, val)
-	r := s.Match(sub)
+	r, _ := s.Match(sub)
 	verifyLen(r, 1, t)
 	verifyMember(r, val, t)
 }
 
 func TestPartialWildcard(t *testing.T) {
-	s := NewSublist()
+	s := NewSublist[string]()
 	literal := "a.b.c"
 	pwc := "a.*.c"
 	a, b := "a", "b"
 	s.Insert(literal, a)
 	s.Insert(pwc, b)
-	r := s.Match(literal)
+	r, _ := s.Match(literal)
 	verifyLen(r, 2, t)
 	verifyMember(r, a, t)
 	verifyMember(r, b, t)
 }
 
 func TestPartialWildcardAtEnd(t *testing.T) {
-	s := NewSublist()
+	s := NewSublist[string]()
 	literal := "a.b.c"
 	pwc := "a.b.*"
 	a, b := "a", "b"
 	s.Insert(literal, a)
 	s.Insert(pwc, b)
-	r := s.Match(literal)
+	r, _ := s.Match(literal)
 	verifyLen(r, 2, t)
 	verifyMember(r, a, t)
 	verifyMember(r, b, t)
 }
 
 func TestFullWildcard(t *testing.T) {
-	s := NewSublist()
+	s := NewSublist[string]()
 	literal := "a.b.c"
 	fwc := "a.>"
 	a, b := "a", "b"
 	s.Insert(literal, a)
 	s.Insert(fwc, b)
-	r := s.Match(literal)
+	r, _ := s.Match(literal)
 	verifyLen(r, 2, t)
 	verifyMember(r, a, t)
 	verifyMember(r, b, t)
 }
 
 func TestRemove(t *testing.T) {
-	s := NewSublist()
+	s := NewSublist[string]()
 	literal := "a.b.c.d"
 	value := "foo"
 	s.Insert(literal, value)
@@ -124,12 +134,12 @@ func TestRemove(t *testing.T) {
 	verifyCount(s, 1, t)
 	s.Remove(literal, value)
 	verifyCount(s, 0, t)
-	r := s.Match(literal)
+	r, _ := s.Match(literal)
 	verifyLen(r, 0, t)
 }
 
 func TestRemoveWildcard(t *testing.T) {
-	s := NewSublist()
+	s := NewSublist[string]()
 	literal := "a.b.c.d"
 	pwc := "a.b.*.d"
 	fwc := "a.b.>"
@@ -138,7 +148,7 @@ func TestRemoveWildcard(t *testing.T) {
 	s.Insert(fwc, value)
 	s.Insert(literal, value)
 	verifyCount(s, 3, t)
-	r := s.Match(literal)
+	r, _ := s.Match(literal)
 	verifyLen(r, 3, t)
 	s.Remove(literal, value)
 	verifyCount(s, 2, t)
@@ -149,7 +159,7 @@ func TestRemoveWildcard(t *testing.T) {
 }
 
 func TestRemoveCleanup(t *testing.T) {
-	s := NewSublist()
+	s := NewSublist[string]()
 	literal := "a.b.c.d.e.f"
 	depth := len(strings.Split(literal, "."))
 	value := "foo"
@@ -161,7 +171,7 @@ func TestRemoveCleanup(t *testing.T) {
 }
 
 func TestRemoveCleanupWildcards(t *testing.T) {
-	s := NewSublist()
+	s := NewSublist[string]()
 	literal := "a.b.*.d.e.>"
 	depth := len(strings.Split(literal, "."))
 	value := "foo"
@@ -172,25 +182,381 @@ func TestRemoveCleanupWildcards(t *testing.T) {
 	verifyNumLevels(s, 0, t)
 }
 
+func TestInvalidSubjects(t *testing.T) {
+	s := NewSublist[string]()
+	deep := strings.Repeat("a.", maxSubjectTokens) + "a"
+	for _, subject := range []string{"", ".", "a..b", "a.", ".a", "a.>.b", ">.a", "a.b*", "a.*b", "a.b>", deep} {
+		if err := s.Insert(subject, "v"); !errors.Is(err, ErrInvalidSubject) {
+			t.Errorf("Insert(%q) expected ErrInvalidSubject, got %v", subject, err)
+		}
+		if err := s.Remove(subject, "v"); !errors.Is(err, ErrInvalidSubject) {
+			t.Errorf("Remove(%q) expected ErrInvalidSubject, got %v", subject, err)
+		}
+		if _, err := s.Match(subject); !errors.Is(err, ErrInvalidSubject) {
+			t.Errorf("Match(%q) expected ErrInvalidSubject, got %v", subject, err)
+		}
+	}
+	verifyCount(s, 0, t)
+
+	// Wildcards are only valid in subscription subjects.
+	for _, subject := range []string{"*", ">", "a.*", "a.>", "a.*.b"} {
+		if err := s.Insert(subject, "v"); err != nil {
+			t.Errorf("Insert(%q) unexpected error: %v", subject, err)
+		}
+		if _, err := s.Match(subject); !errors.Is(err, ErrInvalidSubject) {
+			t.Errorf("Match(%q) expected ErrInvalidSubject, got %v", subject, err)
+		}
+	}
+	if _, err := s.Match(strings.Repeat("a.", maxSubjectTokens-1) + "a"); err != nil {
+		t.Errorf("Match at max depth unexpected error: %v", err)
+	}
+
+	var se *SubjectError
+	if err := s.Insert("a..b", "v"); !errors.As(err, &se) || se.Subject != "a..b" {
+		t.Errorf("Expected a SubjectError for a..b, got %v", err)
+	}
+}
+
+func TestIntersects(t *testing.T) {
+	checkBool(Intersects("foo", "foo"), true, t)
+	checkBool(Intersects("foo", "bar"), false, t)
+	checkBool(Intersects("foo", "*"), true, t)
+	checkBool(Intersects("foo", ">"), true, t)
+	checkBool(Intersects("foo.bar", "*"), false, t)
+	checkBool(Intersects("foo.bar", ">"), true, t)
+	checkBool(Intersects("foo.*", "*.bar"), true, t)
+	checkBool(Intersects("foo.*", "bar.*"), false, t)
+	checkBool(Intersects("foo.>", "foo"), false, t)
+	checkBool(Intersects("foo.>", "*.bar.baz"), true, t)
+	checkBool(Intersects("chat.user.>", "chat.*.1000"), true, t)
+	checkBool(Intersects("chat.user.>", "chat.room.>"), false, t)
+	checkBool(Intersects("a.*.c", "a.b.*"), true, t)
+	checkBool(Intersects("a.*.c", "a.b.d"), false, t)
+	checkBool(Intersects("a..b", "a..b"), false, t)
+}
+
+func TestMatchPattern(t *testing.T) {
+	s := NewSublist[string]()
+	stored := []string{
+		"chat.user.1000", "chat.user.1001", "chat.user.*", "chat.*.1000",
+		"chat.>", "chat.room.1", "chat.room.*", "chat", ">", "*.user.>",
+		"$.service.chat.sub", "chat.user.1000.typing",
+	}
+	for _, subject := range stored {
+		s.Insert(subject, subject)
+	}
+
+	r, _ := s.MatchPattern("chat.user.>")
+	verifyLen(r, 8, t)
+	for _, v := range []string{"chat.user.1000", "chat.user.1001", "chat.user.*",
+		"chat.*.1000", "chat.>", ">", "*.user.>", "chat.user.1000.typing"} {
+		verifyMember(r, v, t)
+	}
+
+	// Cross check every pattern against a brute force scan.
+	for _, pattern := range append(stored, "*", "*.*", "*.*.*", "chat.*", "chat.room.>", "other.>") {
+		r, err := s.MatchPattern(pattern)
+		if err != nil {
+			t.Fatalf("MatchPattern(%q) unexpected error: %v", pattern, err)
+		}
+		expected := 0
+		for _, subject := range stored {
+			if Intersects(subject, pattern) {
+				expected++
+				verifyMember(r, subject, t)
+			}
+		}
+		if len(r) != expected {
+			t.Errorf("MatchPattern(%q) returned %v, expected %d results", pattern, r, expected)
+		}
+	}
+
+	if _, err := s.MatchPattern("chat.>.x"); !errors.Is(err, ErrInvalidSubject) {
+		t.Fatalf("Expected ErrInvalidSubject, got %v", err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	s := NewSublist[string]()
+	s.Insert("b.>", "4")
+	s.Insert("a.b", "1")
+	s.Insert("a.b", "2")
+	s.Insert("a.*", "3")
+	s.Insert("b", "5")
+
+	var visited []string
+	s.Walk(func(subject string, sub string) bool {
+		visited = append(visited, subject+"="+sub)
+		return true
+	})
+	expected := "a.b=1 a.b=2 a.*=3 b=5 b.>=4"
+	if strings.Join(visited, " ") != expected {
+		t.Fatalf("Walk visited %v, expected %s", visited, expected)
+	}
+
+	visited = visited[:0]
+	s.Walk(func(subject string, sub string) bool {
+		visited = append(visited, subject)
+		return len(visited) < 2
+	})
+	verifyLen(visited, 2, t)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	s := NewSublist[string]()
+	for _, subject := range []string{"chat.user.1000", "chat.user.*", "chat.>", "$.service.chat.sub"} {
+		s.Insert(subject, subject)
+	}
+	s.Match("chat.user.1000")
+
+	data, err := json.Marshal(s.Snapshot())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var entries []SublistEntry[string]
+	if err := json.Unmarshal(data, &entries); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	verifyLen(entries, 4, t)
+
+	r := NewSublistWithOptions[string](SublistOptions{CacheMax: 8, CachePolicy: CacheLRU})
+	r.Insert("stale", "stale")
+	if err := r.Restore(entries); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	verifyCount(r, 4, t)
+	m, _ := r.Match("chat.user.1000")
+	verifyLen(m, 3, t)
+	m, _ = r.Match("stale")
+	verifyLen(m, 0, t)
+	if st := r.Stats(); st.CacheMax != 8 || st.CachePolicy != CacheLRU {
+		t.Fatalf("Restore lost cache options: %+v", st)
+	}
+
+	// An invalid entry leaves the current content untouched.
+	bad := append(entries, SublistEntry[string]{Subject: "a..b", Value: "x"})
+	if err := r.Restore(bad); !errors.Is(err, ErrInvalidSubject) {
+		t.Fatalf("Expected ErrInvalidSubject, got %v", err)
+	}
+	verifyCount(r, 4, t)
+}
+
+func TestQueueGroups(t *testing.T) {
+	s := NewSublist[string]()
+	s.Insert("a.b", "plain")
+	s.InsertQueue("a.b", "q1", "q1.a")
+	s.InsertQueue("a.*", "q1", "q1.b")
+	s.InsertQueue("a.>", "q2", "q2.a")
+	s.InsertQueue("x.y", "q1", "other")
+	verifyCount(s, 5, t)
+
+	r, _ := s.MatchResult("a.b")
+	verifyLen(r.Subs, 1, t)
+	verifyMember(r.Subs, "plain", t)
+	if len(r.Queues) != 2 || r.Queues[0].Name != "q1" || r.Queues[1].Name != "q2" {
+		t.Fatalf("Unexpected queue groups: %+v", r.Queues)
+	}
+	verifyLen(r.Queues[0].Members, 2, t)
+	verifyMember(r.Queues[0].Members, "q1.a", t)
+	verifyMember(r.Queues[0].Members, "q1.b", t)
+	verifyLen(r.Queues[1].Members, 1, t)
+	if r.Len() != 4 || r.Fanout() != 3 {
+		t.Fatalf("Unexpected Len %d or Fanout %d", r.Len(), r.Fanout())
+	}
+	all, _ := s.Match("a.b")
+	verifyLen(all, 4, t)
+
+	// Cached results are updated copy on write, groups come and go.
+	s.InsertQueue("a.b", "q0", "q0.a")
+	s.RemoveQueue("a.>", "q2", "q2.a")
+	s.RemoveQueue("a.b", "q2", "q1.a")
+	r2, _ := s.MatchResult("a.b")
+	if len(r2.Queues) != 2 || r2.Queues[0].Name != "q0" || r2.Queues[1].Name != "q1" {
+		t.Fatalf("Unexpected queue groups: %+v", r2.Queues)
+	}
+	verifyLen(r2.Queues[1].Members, 2, t)
+	if len(r.Queues) != 2 || r.Queues[1].Name != "q2" {
+		t.Fatalf("Previous result was modified: %+v", r.Queues)
+	}
+
+	// The same value is kept apart in plain and queue entries.
+	s.Remove("a.b", "q1.a")
+	verifyCount(s, 5, t)
+	s.RemoveQueue("a.b", "q1", "q1.a")
+	s.RemoveQueue("a.*", "q1", "q1.b")
+	s.RemoveQueue("a.b", "q0", "q0.a")
+	verifyCount(s, 2, t)
+	r3, _ := s.MatchResult("a.b")
+	verifyLen(r3.Queues, 0, t)
+	verifyLen(r3.Subs, 1, t)
+
+	// Queue entries are part of snapshots.
+	snapshot := s.Snapshot()
+	verifyLen(snapshot, 2, t)
+	if snapshot[1].Subject != "x.y" || snapshot[1].Queue != "q1" {
+		t.Fatalf("Unexpected snapshot: %+v", snapshot)
+	}
+	c := NewSublist[string]()
+	c.Restore(snapshot)
+	r4, _ := c.MatchResult("x.y")
+	if len(r4.Queues) != 1 || r4.Queues[0].Members[0] != "other" {
+		t.Fatalf("Unexpected restored queue groups: %+v", r4.Queues)
+	}
+
+	s.Remove("a.b", "plain")
+	s.RemoveQueue("x.y", "q1", "other")
+	verifyNumLevels(s, 0, t)
+}
+
 func TestCacheBehavior(t *testing.T) {
-	s := NewSublist()
+	s := NewSublist[string]()
 	literal := "a.b.c"
 	fwc := "a.>"
 	a, b := "a", "b"
 	s.Insert(literal, a)
-	r := s.Match(literal)
+	r, _ := s.Match(literal)
 	verifyLen(r, 1, t)
 	s.Insert(fwc, b)
-	r = s.Match(literal)
+	r, _ = s.Match(literal)
 	verifyLen(r, 2, t)
 	verifyMember(r, a, t)
 	verifyMember(r, b, t)
 	s.Remove(fwc, b)
-	r = s.Match(literal)
+	r, _ = s.Match(literal)
 	verifyLen(r, 1, t)
 	verifyMember(r, a, t)
 }
 
+func TestCacheRemoveIsPrecise(t *testing.T) {
+	s := NewSublist[string]()
+	literal := "a.b.c"
+	s.Insert(literal, "a")
+	s.Insert("a.*.c", "b")
+	s.Insert("a.>", "b")
+	r, _ := s.Match(literal)
+	verifyLen(r, 3, t)
+
+	// Only one occurrence of "b" goes away and the entry stays cached.
+	s.Remove("a.>", "b")
+	cached, ok := s.cache.get(literal)
+	if !ok {
+		t.Fatalf("Expected %q to stay cached after Remove", literal)
+	}
+	verifyLen(cached.Subs, 2, t)
+	verifyMember(cached.Subs, "a", t)
+	verifyMember(cached.Subs, "b", t)
+	verifyLen(r, 3, t)
+
+	// Entries not matching the removed subject are left untouched.
+	s.Match("x.y")
+	s.Insert("x.y", "x")
+	s.Remove("a.*.c", "b")
+	cached, _ = s.cache.get("x.y")
+	verifyLen(cached.Subs, 1, t)
+	verifyMember(cached.Subs, "x", t)
+	cached, _ = s.cache.get(literal)
+	verifyLen(cached.Subs, 1, t)
+	verifyMember(cached.Subs, "a", t)
+}
+
+func TestMatchResultsAreSnapshots(t *testing.T) {
+	s := NewSublist[string]()
+	literal := "a.b.c"
+	s.Insert(literal, "a")
+	s.Insert("a.>", "b")
+	r, _ := s.Match(literal)
+	snapshot := append([]string(nil), r...)
+
+	s.Insert("a.*.c", "c")
+	s.Remove(literal, "a")
+	s.Insert(literal, "d")
+	if len(r) != len(snapshot) {
+		t.Fatalf("Match result changed length: %v vs %v", r, snapshot)
+	}
+	for i := range r {
+		if r[i] != snapshot[i] {
+			t.Fatalf("Match result changed: %v vs %v", r, snapshot)
+		}
+	}
+
+	// Appending to a result must not leak into the cache.
+	_ = append(r, "e")
+	r2, _ := s.Match(literal)
+	verifyLen(r2, 3, t)
+	for _, v := range r2 {
+		if v == "e" || v == "a" {
+			t.Fatalf("Unexpected value %q in %v", v, r2)
+		}
+	}
+}
+
+// TestConcurrentMatchSnapshots is meant to be run with -race: readers
+// iterate over results while writers insert and remove matching entries.
+func TestConcurrentMatchSnapshots(t *testing.T) {
+	s := NewSublist[string]()
+	subjects := []string{"snap.a", "snap.b", "snap.c"}
+	s.Insert("snap.>", "fwc")
+
+	var writers, readers sync.WaitGroup
+	stop := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			pattern := []string{"snap.*", "snap.a", "snap.>"}[w%3]
+			val := fmt.Sprintf("w%d", w)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.Insert(pattern, val)
+				s.Remove(pattern, val)
+				runtime.Gosched()
+			}
+		}(w)
+	}
+
+	errs := make(chan string, 8)
+	for rd := 0; rd < 8; rd++ {
+		readers.Add(1)
+		go func(rd int) {
+			defer readers.Done()
+			for i := 0; i < 500; i++ {
+				r, err := s.Match(subjects[(rd+i)%len(subjects)])
+				if err != nil {
+					errs <- err.Error()
+					return
+				}
+				snapshot := append([]string(nil), r...)
+				runtime.Gosched()
+				for j := range r {
+					if r[j] != snapshot[j] {
+						errs <- fmt.Sprintf("result changed: %v vs %v", r, snapshot)
+						return
+					}
+				}
+			}
+		}(rd)
+	}
+	readers.Wait()
+	close(stop)
+	writers.Wait()
+	close(errs)
+	for e := range errs {
+		t.Error(e)
+	}
+
+	// Once quiet, every subject only matches the remaining wildcard.
+	for _, subject := range subjects {
+		r, _ := s.Match(subject)
+		verifyLen(r, 1, t)
+		verifyMember(r, "fwc", t)
+	}
+	verifyCount(s, 1, t)
+}
+
 func checkBool(b, expected bool, t *testing.T) {
 	if b != expected {
 		debug.PrintStack()
@@ -211,7 +577,7 @@ func TestMatchLiterals(t *testing.T) {
 }
 
 func TestCacheBounds(t *testing.T) {
-	s := NewSublist()
+	s := NewSublist[string]()
 	s.Insert("cache.>", "foo")
 
 	tmpl := "cache.test.%d"
@@ -221,14 +587,174 @@ func TestCacheBounds(t *testing.T) {
 		sub := fmt.Sprintf(tmpl, i)
 		s.Match(sub)
 	}
-	cs := int(len(s.cache))
+	cs := s.cache.len()
 	if cs > s.cmax {
 		t.Fatalf("Cache is growing past limit: %d vs %d\n", cs, s.cmax)
 	}
 }
 
+func TestCacheBoundsWithOptions(t *testing.T) {
+	for _, policy := range []CachePolicy{CacheRandom, CacheLRU} {
+		s := NewSublistWithOptions[string](SublistOptions{CacheMax: 16, CachePolicy: policy})
+		s.Insert("cache.>", "foo")
+
+		for i := 0; i < 100; i++ {
+			r, _ := s.Match(fmt.Sprintf("cache.test.%d", i))
+			verifyLen(r, 1, t)
+		}
+		stats := s.Stats()
+		if stats.NumCache != 16 {
+			t.Fatalf("%s: Wrong stats for NumCache: %d vs %d\n", policy, stats.NumCache, 16)
+		}
+		if stats.NumEvictions != 84 {
+			t.Fatalf("%s: Wrong stats for NumEvictions: %d vs %d\n", policy, stats.NumEvictions, 84)
+		}
+		if stats.CacheMax != 16 {
+			t.Fatalf("%s: Wrong stats for CacheMax: %d vs %d\n", policy, stats.CacheMax, 16)
+		}
+	}
+}
+
+func TestCacheLRUEviction(t *testing.T) {
+	s := NewSublistWithOptions[string](SublistOptions{CacheMax: 2, CachePolicy: CacheLRU})
+	s.Insert("lru.>", "foo")
+
+	s.Match("lru.a")
+	s.Match("lru.b")
+	// Touch "lru.a" so that "lru.b" becomes the least recently used.
+	s.Match("lru.a")
+	s.Match("lru.c")
+
+	if _, ok := s.cache.get("lru.a"); !ok {
+		t.Fatalf("Expected lru.a to stay cached")
+	}
+	if _, ok := s.cache.get("lru.b"); ok {
+		t.Fatalf("Expected lru.b to be evicted")
+	}
+	if _, ok := s.cache.get("lru.c"); !ok {
+		t.Fatalf("Expected lru.c to be cached")
+	}
+}
+
+func TestCacheRandomEviction(t *testing.T) {
+	c := newRandomCache[string](8)
+	for i := 0; i < 64; i++ {
+		c.set(fmt.Sprintf("rr.%d", i), "")
+		if c.len() > 8 {
+			t.Fatalf("Cache is growing past limit: %d vs %d\n", c.len(), 8)
+		}
+	}
+	// Every key kept in the slice must be indexed consistently.
+	for i, k := range c.keys {
+		if e, ok := c.entries[k]; !ok || e.idx != i {
+			t.Fatalf("Inconsistent random cache index for %q", k)
+		}
+	}
+	c.refresh(func(subject string, r string) (string, bool) {
+		return r, false
+	})
+	if c.len() != 0 {
+		t.Fatalf("Expected empty cache after refresh, got %d", c.len())
+	}
+}
+
+type testSub struct {
+	name string
+}
+
+func TestTypedValues(t *testing.T) {
+	s := NewSublist[*testSub]()
+	a, b := &testSub{"a"}, &testSub{"a"}
+	s.Insert("foo.*", a)
+	s.Insert("foo.bar", b)
+	r, _ := s.Match("foo.bar")
+	verifyLen(r, 2, t)
+	verifyMember(r, a, t)
+	verifyMember(r, b, t)
+
+	// Values are compared by identity, not by content.
+	s.Remove("foo.bar", &testSub{"a"})
+	verifyCount(s, 2, t)
+	s.Remove("foo.bar", b)
+	verifyCount(s, 1, t)
+	r, _ = s.Match("foo.bar")
+	verifyLen(r, 1, t)
+	verifyMember(r, a, t)
+}
+
+func TestAnySublist(t *testing.T) {
+	s := NewAnySublist()
+	s.Insert("foo.>", "a")
+	s.Insert("foo.bar", "a")
+	s.Insert("foo.bar", 1)
+	r, _ := s.Match("foo.bar")
+	verifyLen(r, 3, t)
+	verifyAnyMember(r, "a", t)
+	verifyAnyMember(r, 1, t)
+
+	s.Remove("foo.bar", "a")
+	s.Remove("foo.bar", 2)
+	if s.Count() != 2 {
+		t.Fatalf("Count is %d, should be %d", s.Count(), 2)
+	}
+	r, _ = s.Match("foo.bar")
+	verifyLen(r, 2, t)
+	verifyAnyMember(r, "a", t)
+
+	s.Remove("foo.>", "a")
+	s.Remove("foo.bar", 1)
+	if s.Count() != 0 {
+		t.Fatalf("Count is %d, should be %d", s.Count(), 0)
+	}
+	if len(s.refs) != 0 {
+		t.Fatalf("Expected no references left, got %d", len(s.refs))
+	}
+}
+
+func TestCacheShards(t *testing.T) {
+	s := NewSublist[string]()
+	if st := s.Stats(); st.CacheShards != maxCacheShards {
+		t.Fatalf("Wrong stats for CacheShards: %d vs %d\n", st.CacheShards, maxCacheShards)
+	}
+	s = NewSublistWithOptions[string](SublistOptions{CacheMax: 4, CacheShards: 8})
+	if st := s.Stats(); st.CacheShards != 4 {
+		t.Fatalf("Wrong stats for CacheShards: %d vs %d\n", st.CacheShards, 4)
+	}
+
+	s = NewSublistWithOptions[string](SublistOptions{CacheMax: 256, CacheShards: 4})
+	s.Insert("shard.>", "foo")
+	for i := 0; i < 1000; i++ {
+		r, _ := s.Match(fmt.Sprintf("shard.%d", i))
+		verifyLen(r, 1, t)
+	}
+	s.Insert("shard.*", "bar")
+	s.Match("shard.1")
+	st := s.Stats()
+	if st.NumCache > 256 {
+		t.Fatalf("Cache is growing past limit: %d vs %d\n", st.NumCache, 256)
+	}
+	if st.NumEvictions == 0 {
+		t.Fatalf("Expected evictions once the shards are full")
+	}
+	// Inserts must reach cached entries in every shard.
+	for i := 0; i < 1000; i++ {
+		r, _ := s.Match(fmt.Sprintf("shard.%d", i))
+		verifyLen(r, 2, t)
+	}
+
+	// The shards together hold exactly CacheMax subjects.
+	s = NewSublistWithOptions[string](SublistOptions{CacheMax: 1003, CacheShards: 4})
+	s.Insert("shard.>", "foo")
+	for i := 0; i < 10000; i++ {
+		s.Match(fmt.Sprintf("shard.%d", i))
+	}
+	if st := s.Stats(); st.NumCache != 1003 || st.CacheMax != 1003 {
+		t.Fatalf("Expected the cache to hold %d subjects, got %d of %d\n", 1003, st.NumCache, st.CacheMax)
+	}
+}
+
 func TestStats(t *testing.T) {
-	s := NewSublist()
+	s := NewSublist[string]()
 	s.Insert("stats.>", "fwc")
 	tmpl := "stats.test.%d"
 	loop := 255
@@ -273,8 +799,20 @@ func TestStats(t *testing.T) {
 	if stats.MaxFanout != 3 {
 		t.Fatalf("Wrong stats for MaxFanout: %d vs %d\n", stats.MaxFanout, 3)
 	}
+	// Only "stats.test.22" is cached so far.
+	if stats.AvgFanout != 3 {
+		t.Fatalf("Wrong stats for AvgFanout: %f vs %f\n", stats.AvgFanout, 3.0)
+	}
+	s.Match("stats.22.test")
+	stats = s.Stats()
 	if stats.AvgFanout != 2.5 {
-		t.Fatalf("Wrong stats for MaxFanout: %f vs %f\n", stats.AvgFanout, 2.5)
+		t.Fatalf("Wrong stats for AvgFanout: %f vs %f\n", stats.AvgFanout, 2.5)
+	}
+	if len(stats.HotSubjects) != 2 || stats.HotSubjects[0].Subject != "stats.test.22" || stats.HotSubjects[0].Matches != 256 {
+		t.Fatalf("Wrong stats for HotSubjects: %+v\n", stats.HotSubjects)
+	}
+	if len(stats.TopFanout) != 2 || stats.TopFanout[0].Fanout != 3 || stats.TopFanout[1].Fanout != 2 {
+		t.Fatalf("Wrong stats for TopFanout: %+v\n", stats.TopFanout)
 	}
 
 	s.ResetStats()
@@ -294,14 +832,82 @@ func TestStats(t *testing.T) {
 	if stats.CacheHitRate != 0.0 {
 		t.Fatalf("After Reset: Wrong stats for CacheHitRate: %.3g vs %0.3g\n", stats.CacheHitRate, 0.0)
 	}
+	for _, hs := range stats.HotSubjects {
+		if hs.Matches != 0 {
+			t.Fatalf("After Reset: Wrong stats for HotSubjects: %+v\n", stats.HotSubjects)
+		}
+	}
+}
+
+func TestStatsEmpty(t *testing.T) {
+	stats := NewSublist[string]().Stats()
+	if stats.AvgFanout != 0 || stats.MaxFanout != 0 {
+		t.Fatalf("Wrong fanout stats for empty cache: %f, %d\n", stats.AvgFanout, stats.MaxFanout)
+	}
+	if len(stats.HotSubjects) != 0 || len(stats.TopFanout) != 0 {
+		t.Fatalf("Expected no hot spots for empty cache: %+v\n", stats)
+	}
+}
+
+func TestStatsHotSubjects(t *testing.T) {
+	for _, policy := range []CachePolicy{CacheRandom, CacheLRU} {
+		s := NewSublistWithOptions[string](SublistOptions{CachePolicy: policy, StatsTopN: 3})
+		s.Insert("$.service.*.sub", "all")
+		s.Insert("$.service.chat.sub", "chat")
+		s.Insert("$.service.chat.sub", "chat2")
+		s.Insert("$.service.feed.sub", "feed")
+
+		for i, name := range []string{"chat", "feed", "mail", "news", "echo"} {
+			for j := 0; j <= i*10; j++ {
+				s.Match("$.service." + name + ".sub")
+			}
+		}
+		stats := s.Stats()
+		var hot []string
+		for _, hs := range stats.HotSubjects {
+			hot = append(hot, fmt.Sprintf("%s=%d", hs.Subject, hs.Matches))
+		}
+		expected := "$.service.echo.sub=41 $.service.news.sub=31 $.service.mail.sub=21"
+		if strings.Join(hot, " ") != expected {
+			t.Fatalf("%s: Wrong stats for HotSubjects: %v\n", policy, hot)
+		}
+		if len(stats.TopFanout) != 3 || stats.TopFanout[0].Subject != "$.service.chat.sub" ||
+			stats.TopFanout[0].Fanout != 3 || stats.TopFanout[1].Fanout != 2 {
+			t.Fatalf("%s: Wrong stats for TopFanout: %+v\n", policy, stats.TopFanout)
+		}
+	}
+}
+
+func TestConcurrentStats(t *testing.T) {
+	s := NewSublist[string]()
+	s.Insert("stats.>", "fwc")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				s.Match(fmt.Sprintf("stats.%d.%d", i, j%10))
+				if j%50 == 0 {
+					s.Stats()
+					s.ResetStats()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if stats := s.Stats(); stats.NumMatches > 4*200 {
+		t.Fatalf("Wrong stats for NumMatches: %d\n", stats.NumMatches)
+	}
 }
 
 // -- Benchmarks Setup --
 
 var subs []string
 var toks = []string{"apcera", "continuum", "component", "router", "api", "imgr", "jmgr", "auth"}
-var sl = NewSublist()
-var results = make([]interface{}, 0, 64)
+var sl = NewSublist[string]()
+var results = make([]string, 0, 64)
 
 func init() {
 	subs = make([]string, 0, 256*1024)
@@ -338,7 +944,7 @@ func addWildcards() {
 
 func Benchmark______________________Insert(b *testing.B) {
 	b.SetBytes(1)
-	s := NewSublist()
+	s := NewSublist[string]()
 	for i, l := 0, len(subs); i < b.N; i++ {
 		index := i % l
 		s.Insert(subs[index], subs[index])
@@ -385,6 +991,56 @@ func Benchmark_______MissOnLastTokenOfFive(b *testing.B) {
 	}
 }
 
+// benchmarkParallelMisses matches distinct subjects from at least 16
+// goroutines, so that most lookups miss the cache and walk the trie.
+func benchmarkParallelMisses(b *testing.B, opts SublistOptions) {
+	s := NewSublistWithOptions[string](opts)
+	for i := 0; i < len(subs); i++ {
+		s.Insert(subs[i], subs[i])
+	}
+	s.Insert("apcera.>", "fwc")
+
+	subjects := make([]string, 64*1024)
+	for i := range subjects {
+		subjects[i] = fmt.Sprintf("apcera.continuum.component.%d", i)
+	}
+
+	var id uint64
+	b.SetBytes(1)
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint64(&id, 1)) * 4096
+		for pb.Next() {
+			s.Match(subjects[i%len(subjects)])
+			i++
+		}
+	})
+}
+
+func Benchmark_ParallelMissesSingleShard(b *testing.B) {
+	benchmarkParallelMisses(b, SublistOptions{CacheShards: 1})
+}
+
+func Benchmark___ParallelMissesSharded(b *testing.B) {
+	benchmarkParallelMisses(b, SublistOptions{})
+}
+
+func Benchmark_ParallelMissesShardedLRU(b *testing.B) {
+	benchmarkParallelMisses(b, SublistOptions{CachePolicy: CacheLRU})
+}
+
+func Benchmark_________ParallelCacheHits(b *testing.B) {
+	b.SetBytes(1)
+	b.SetParallelism(16)
+	s := "cloud.continuum.component.router"
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			sl.Match(s)
+		}
+	})
+}
+
 func _BenchmarkRSS(b *testing.B) {
 	runtime.GC()
 	var m runtime.MemStats